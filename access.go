@@ -2,6 +2,8 @@ package storage
 
 import (
 	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
 
 	"time"
 )
@@ -18,9 +20,61 @@ type Access struct {
 	RedirectUri  string    // Redirect Uri from request
 	CreatedAt    time.Time // Date created
 	UserData     string    // Data to be passed to storage. Not used by the library.
+
+	OpenIDRequest // OpenID Connect request parameters
+
+	Client        Client    `gorm:"save_associations:false" json:"-"`                                                  // Client association
+	AuthorizeData Authorize `gorm:"foreignkey:Authorize;association_foreignkey:Code;save_associations:false" json:"-"` // Authorize association
 }
 
 // TableName is used by `gorm`
 func (Access) TableName(db *gorm.DB) string {
 	return gorm.DefaultTableNameHandler(db, "oauth_access")
 }
+
+// ToOsin converts the model to osin.AccessData using client as its client
+func (a *Access) ToOsin(client osin.Client) *osin.AccessData {
+	oa := &osin.AccessData{
+		Client:       client,
+		AccessToken:  a.AccessToken,
+		RefreshToken: a.RefreshToken,
+		ExpiresIn:    a.ExpiresIn,
+		Scope:        a.Scope,
+		RedirectUri:  a.RedirectUri,
+		CreatedAt:    a.CreatedAt,
+	}
+	oa.UserData = model.JoinUserData(a.OpenIDRequest, a.UserData)
+	return oa
+}
+
+// AccessFromOsin converts osin.AccessData to the model
+func AccessFromOsin(data *osin.AccessData) (Access, error) {
+	access := Access{
+		ClientID:     data.Client.GetId(),
+		AccessToken:  data.AccessToken,
+		RefreshToken: data.RefreshToken,
+		ExpiresIn:    data.ExpiresIn,
+		Scope:        data.Scope,
+		RedirectUri:  data.RedirectUri,
+		CreatedAt:    data.CreatedAt,
+	}
+
+	if data.UserData != nil {
+		var userData interface{}
+		access.OpenIDRequest, userData = model.SplitUserData(data.UserData)
+		v, err := model.UserDataToString(userData)
+		if err != nil {
+			return access, err
+		}
+		access.UserData = v
+	}
+
+	if data.AccessData != nil {
+		access.PrvAccess = data.AccessData.AccessToken
+	}
+
+	if data.AuthorizeData != nil {
+		access.Authorize = data.AuthorizeData.Code
+	}
+	return access, nil
+}
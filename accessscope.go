@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// AccessScope model, a scope of an access token.
+// SaveAccess indexes the scopes of access data so tokens can be found by scope,
+// Access.Scope keeps the scope as issued.
+type AccessScope struct {
+	AccessToken string `gorm:"primary_key"`       // Access token, the jti of JWT access tokens
+	Scope       string `gorm:"primary_key;index"` // Scope name
+}
+
+// TableName is used by `gorm`
+func (AccessScope) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_access_scope")
+}
+
+// saveAccessScopes indexes the scopes of access within tx
+func saveAccessScopes(tx *gorm.DB, access *Access) error {
+	for _, scope := range strings.Fields(model.NormalizeScope(access.Scope)) {
+		if err := tx.Create(&AccessScope{AccessToken: access.AccessToken, Scope: scope}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindAccessByScope returns the access data having scope, with their client loaded.
+// The AccessToken of JWT access tokens is their jti.
+func (s *Storage) FindAccessByScope(scope string) ([]*osin.AccessData, error) {
+	var tokens []string
+	if err := s.db.Model(&AccessScope{}).Where("scope = ?", scope).Pluck("access_token", &tokens).Error; err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	var access []Access
+	for len(tokens) > 0 {
+		batch := tokens
+		if len(batch) > purgeBatch {
+			batch = batch[:purgeBatch]
+		}
+		tokens = tokens[len(batch):]
+		var found []Access
+		if err := s.db.Preload("Client").Preload("AuthorizeData").Where("access_token IN (?)", batch).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		access = append(access, found...)
+	}
+	data := make([]*osin.AccessData, 0, len(access))
+	for i := range access {
+		oa, err := s.accessToOsin(&access[i])
+		if err == gorm.ErrRecordNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, oa)
+	}
+	return data, nil
+}
+
+// RevokeByScope removes the access data having scope, e.g. after the permission was withdrawn,
+// and returns how many were removed. Every removal goes through BeforeAccessRemoved like with RemoveAccess,
+// nothing is removed when one is vetoed. The tokens are deleted in batches within a single transaction. The tokens passed to the hooks are the jti of JWT access tokens.
+func (s *Storage) RevokeByScope(scope string) (int64, error) {
+	var tokens []string
+	if err := s.db.Model(&AccessScope{}).Where("scope = ?", scope).Pluck("access_token", &tokens).Error; err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	ctx := s.context()
+	for _, token := range tokens {
+		err := s.before(func(h *Hooks) error {
+			if h.BeforeAccessRemoved == nil {
+				return nil
+			}
+			return h.BeforeAccessRemoved(ctx, token)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var removed []Access
+	err := s.transaction(func(tx *gorm.DB) error {
+		// the tokens are deleted in batches bounding the parameters of each statement, all in one transaction
+		for rest := tokens; len(rest) > 0; {
+			batch := rest
+			if len(batch) > purgeBatch {
+				batch = batch[:purgeBatch]
+			}
+			rest = rest[len(batch):]
+
+			var access []Access
+			if err := tx.Select("access_token, client_id, subject").Where("access_token IN (?)", batch).Find(&access).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("access_token IN (?)", batch).Delete(&Access{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("access_token IN (?)", batch).Delete(&AccessScope{}).Error; err != nil {
+				return err
+			}
+			for _, a := range access {
+				if err := s.record(tx, EventAccessRemoved, a.ClientID, a.Subject, a.AccessToken); err != nil {
+					return err
+				}
+			}
+			removed = append(removed, access...)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range removed {
+		token := a.AccessToken
+		s.after(func(h *Hooks) {
+			if h.OnAccessRemoved != nil {
+				h.OnAccessRemoved(ctx, token)
+			}
+		})
+	}
+	return int64(len(removed)), nil
+}
+
+// indexBatch is the number of access tokens IndexAccessScopes reads at a time
+const indexBatch = 500
+
+// IndexAccessScopes indexes the scopes of the access data saved before the oauth_access_scope table existed,
+// so FindAccessByScope and RevokeByScope find them, and returns how many tokens it indexed.
+// Tokens already indexed are skipped, run it once after migrating.
+func (s *Storage) IndexAccessScopes() (int64, error) {
+	var n int64
+	last := ""
+	for {
+		var batch []Access
+		if err := s.db.Select("access_token, scope").Where("access_token > ?", last).Order("access_token").Limit(indexBatch).Find(&batch).Error; err != nil {
+			return n, err
+		}
+		if len(batch) == 0 {
+			return n, nil
+		}
+		tokens := make([]string, len(batch))
+		for i := range batch {
+			tokens[i] = batch[i].AccessToken
+		}
+		var indexed []string
+		if err := s.db.Model(&AccessScope{}).Where("access_token IN (?)", tokens).Pluck("DISTINCT access_token", &indexed).Error; err != nil {
+			return n, err
+		}
+		done := make(map[string]bool, len(indexed))
+		for _, token := range indexed {
+			done[token] = true
+		}
+		err := s.transaction(func(tx *gorm.DB) error {
+			for i := range batch {
+				if done[batch[i].AccessToken] || batch[i].Scope == "" {
+					continue
+				}
+				if err := saveAccessScopes(tx, &batch[i]); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		last = batch[len(batch)-1].AccessToken
+	}
+}
@@ -0,0 +1,97 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestRevokeByScope(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	errVetoed := errors.New("vetoed")
+	veto := "scoped-1"
+	var removed []string
+	s := storage.NewStorage(db, storage.WithHooks(storage.Hooks{
+		BeforeAccessRemoved: func(ctx context.Context, token string) error {
+			if token == veto {
+				return errVetoed
+			}
+			return nil
+		},
+		OnAccessRemoved: func(ctx context.Context, token string) {
+			removed = append(removed, token)
+		},
+	}))
+	client := &osin.DefaultClient{Id: "scoped", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"scoped-1", "scoped-2"} {
+		data := &osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 3600, Scope: "read admin", CreatedAt: time.Now()}
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tokens saved before the scope index existed are found once indexed
+	if err := db.Delete(&storage.AccessScope{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.IndexAccessScopes(); err != nil || n != 2 {
+		t.Fatalf("IndexAccessScopes = %d, %v, want 2", n, err)
+	}
+	if n, err := s.IndexAccessScopes(); err != nil || n != 0 {
+		t.Errorf("IndexAccessScopes again = %d, %v, want 0", n, err)
+	}
+	if found, err := s.FindAccessByScope("admin"); err != nil || len(found) != 2 {
+		t.Fatalf("FindAccessByScope = %d, %v, want 2", len(found), err)
+	}
+
+	if _, err := s.RevokeByScope("admin"); err != errVetoed {
+		t.Fatalf("RevokeByScope = %v, want the veto", err)
+	}
+	if found, _ := s.FindAccessByScope("admin"); len(found) != 2 {
+		t.Errorf("FindAccessByScope after veto = %d, want 2", len(found))
+	}
+
+	veto = ""
+	if n, err := s.RevokeByScope("admin"); err != nil || n != 2 {
+		t.Fatalf("RevokeByScope = %d, %v, want 2", n, err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("OnAccessRemoved called for %v, want both tokens", removed)
+	}
+	if _, err := s.LoadAccess("scoped-2"); err == nil {
+		t.Error("LoadAccess after RevokeByScope succeeded")
+	}
+}
+
+func TestRevokeByScopeBatches(t *testing.T) {
+	s := storage.NewStorage(storagetest.OpenDB(t))
+	client := &osin.DefaultClient{Id: "bulk", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	const tokens = 1200
+	for i := 0; i < tokens; i++ {
+		data := &osin.AccessData{Client: client, AccessToken: fmt.Sprintf("bulk-%d", i), ExpiresIn: 3600, Scope: "bulk", CreatedAt: time.Now()}
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found, err := s.FindAccessByScope("bulk"); err != nil || len(found) != tokens {
+		t.Fatalf("FindAccessByScope = %d, %v, want %d", len(found), err, tokens)
+	}
+	if n, err := s.RevokeByScope("bulk"); err != nil || n != tokens {
+		t.Fatalf("RevokeByScope = %d, %v, want %d", n, err, tokens)
+	}
+	if found, err := s.FindAccessByScope("bulk"); err != nil || len(found) != 0 {
+		t.Errorf("FindAccessByScope after RevokeByScope = %d, %v, want none", len(found), err)
+	}
+}
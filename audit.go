@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gislik/gorm"
+)
+
+// Events recorded in the audit log
+const (
+	EventClientSaved      = "client.saved"
+	EventClientRemoved    = "client.removed"
+	EventAuthorizeSaved   = "authorize.saved"
+	EventAuthorizeRemoved = "authorize.removed"
+	EventAccessSaved      = "access.saved"
+	EventAccessRemoved    = "access.removed"
+	EventRefreshRemoved   = "refresh.removed"
+)
+
+// AuditEvent model, an entry of the append-only audit log written by Storage configured WithAudit.
+// Entries are written in the same transaction as the mutation they record.
+type AuditEvent struct {
+	ID               uint64    `gorm:"primary_key" json:"id"`
+	Event            string    `gorm:"index" json:"event"`             // One of the Event constants
+	ClientID         string    `gorm:"index" json:"client_id"`         // Client information
+	Subject          string    `gorm:"index" json:"subject,omitempty"` // End-user, when known
+	TokenFingerprint string    `json:"token_fingerprint,omitempty"`    // TokenFingerprint of the token, never the token
+	IP               string    `json:"ip,omitempty"`                   // Client IP from the context
+	UserAgent        string    `json:"user_agent,omitempty"`           // User agent from the context
+	CreatedAt        time.Time `gorm:"index" json:"created_at"`        // Date of the event
+}
+
+// TableName is used by `gorm`
+func (AuditEvent) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_audit")
+}
+
+// TokenFingerprint identifies token in logs without disclosing it
+func TokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RequestInfo describes the HTTP request behind a storage call
+type RequestInfo struct {
+	IP        string
+	UserAgent string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of ctx carrying info
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the RequestInfo carried by ctx
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	if ctx == nil {
+		return RequestInfo{}, false
+	}
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// RequestContext returns the context of r carrying its remote IP and user agent.
+// Forwarding headers are not trusted, set the RequestInfo yourself behind a proxy.
+func RequestContext(r *http.Request) context.Context {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return WithRequestInfo(r.Context(), RequestInfo{IP: ip, UserAgent: r.UserAgent()})
+}
+
+// record appends event to the audit log when the storage is configured WithAudit
+// and to the outbox when configured WithOutbox, within tx
+func (s *Storage) record(tx *gorm.DB, event, clientID, subject, token string) error {
+	var fingerprint string
+	if token != "" {
+		fingerprint = TokenFingerprint(token)
+	}
+	now := time.Now()
+	if s.audit {
+		e := AuditEvent{
+			Event:            event,
+			ClientID:         clientID,
+			Subject:          subject,
+			TokenFingerprint: fingerprint,
+			CreatedAt:        now,
+		}
+		if info, ok := RequestInfoFromContext(s.ctx); ok {
+			e.IP, e.UserAgent = info.IP, info.UserAgent
+		}
+		if err := tx.Create(&e).Error; err != nil {
+			return err
+		}
+	}
+	if s.outbox && outboxEvents[event] {
+		e := OutboxEvent{
+			Event:            event,
+			ClientID:         clientID,
+			Subject:          subject,
+			TokenFingerprint: fingerprint,
+			CreatedAt:        now,
+		}
+		if err := tx.Create(&e).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditQuery filters the audit log, zero fields match everything
+type AuditQuery struct {
+	Event    string
+	ClientID string
+	Subject  string
+	Since    time.Time // Inclusive
+	Until    time.Time // Exclusive
+	Limit    int
+}
+
+func (q *AuditQuery) apply(db *gorm.DB) *gorm.DB {
+	db = db.Model(&AuditEvent{})
+	if q.Event != "" {
+		db = db.Where("event = ?", q.Event)
+	}
+	if q.ClientID != "" {
+		db = db.Where("client_id = ?", q.ClientID)
+	}
+	if q.Subject != "" {
+		db = db.Where("subject = ?", q.Subject)
+	}
+	if !q.Since.IsZero() {
+		db = db.Where("created_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("created_at < ?", q.Until)
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	return db.Order("id")
+}
+
+// AuditEvents returns the audit log entries matching q, oldest first
+func (s *Storage) AuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	var events []AuditEvent
+	if err := q.apply(s.db).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ExportAudit writes the audit log entries matching q to w as JSON lines, oldest first
+func (s *Storage) ExportAudit(w io.Writer, q AuditQuery) error {
+	db := q.apply(s.db)
+	rows, err := db.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var e AuditEvent
+		if err := db.ScanRows(rows, &e); err != nil {
+			return err
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,106 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestAuditLog(t *testing.T) {
+	r := httptest.NewRequest("POST", "/token", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "audit-test")
+	ctx := storage.RequestContext(r)
+	if info, ok := storage.RequestInfoFromContext(ctx); !ok || info.IP != "192.0.2.1" || info.UserAgent != "audit-test" {
+		t.Fatalf("RequestContext carries %+v, %v", info, ok)
+	}
+
+	s := storage.NewStorage(storagetest.OpenDB(t), storage.WithAudit()).WithContext(ctx)
+	client := &osin.DefaultClient{Id: "audited", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	oid := &storage.OpenIDUserData{OpenIDRequest: storage.OpenIDRequest{Subject: "jane"}}
+	authorize := &osin.AuthorizeData{Client: client, Code: "audited-code", ExpiresIn: 600, RedirectUri: client.RedirectUri, CreatedAt: time.Now(), UserData: oid}
+	access := &osin.AccessData{Client: client, AccessToken: "audited-access", RefreshToken: "audited-refresh", ExpiresIn: 3600, CreatedAt: time.Now(), UserData: oid}
+	refresh := &osin.AccessData{Client: client, AccessToken: "audited-access-2", RefreshToken: "audited-refresh-2", ExpiresIn: 3600, CreatedAt: time.Now(), UserData: oid}
+
+	for _, tc := range []struct {
+		event   string
+		token   string
+		subject string
+		mutate  func() error
+	}{
+		{storage.EventClientSaved, "", "", func() error { return s.SaveClient(client) }},
+		{storage.EventAuthorizeSaved, authorize.Code, "jane", func() error { return s.SaveAuthorize(authorize) }},
+		{storage.EventAuthorizeRemoved, authorize.Code, "jane", func() error { return s.RemoveAuthorize(authorize.Code) }},
+		{storage.EventAccessSaved, access.AccessToken, "jane", func() error { return s.SaveAccess(access) }},
+		{storage.EventAccessRemoved, access.AccessToken, "jane", func() error { return s.RemoveAccess(access.AccessToken) }},
+		{storage.EventAccessSaved, refresh.AccessToken, "jane", func() error { return s.SaveAccess(refresh) }},
+		{storage.EventRefreshRemoved, refresh.RefreshToken, "jane", func() error { return s.RemoveRefresh(refresh.RefreshToken) }},
+		{storage.EventClientRemoved, "", "", func() error { return s.RemoveClient(client.Id) }},
+	} {
+		before, err := s.AuditEvents(storage.AuditQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.mutate(); err != nil {
+			t.Fatalf("%s: %v", tc.event, err)
+		}
+		events, err := s.AuditEvents(storage.AuditQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(before)+1 {
+			t.Fatalf("%s wrote %d audit events, want 1", tc.event, len(events)-len(before))
+		}
+		e := events[len(events)-1]
+		if e.Event != tc.event || e.ClientID != client.Id || e.Subject != tc.subject || e.IP != "192.0.2.1" || e.UserAgent != "audit-test" {
+			t.Errorf("%s: audit event = %+v", tc.event, e)
+		}
+		if tc.token != "" && e.TokenFingerprint != storage.TokenFingerprint(tc.token) {
+			t.Errorf("%s: TokenFingerprint = %q, want the fingerprint of %q", tc.event, e.TokenFingerprint, tc.token)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := s.ExportAudit(&out, storage.AuditQuery{}); err != nil {
+		t.Fatalf("ExportAudit: %v", err)
+	}
+	for _, token := range []string{authorize.Code, access.AccessToken, refresh.RefreshToken} {
+		if strings.Contains(out.String(), token) {
+			t.Errorf("audit log contains the raw token %q", token)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("ExportAudit wrote %d lines, want 8", len(lines))
+	}
+	var first storage.AuditEvent
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.Event != storage.EventClientSaved {
+		t.Errorf("first exported event = %+v, %v, want client.saved", first, err)
+	}
+
+	saved, err := s.AuditEvents(storage.AuditQuery{Event: storage.EventAccessSaved, Subject: "jane", Limit: 1})
+	if err != nil || len(saved) != 1 || saved[0].TokenFingerprint != storage.TokenFingerprint(access.AccessToken) {
+		t.Errorf("AuditEvents filtered = %+v, %v, want the first access.saved", saved, err)
+	}
+	if events, err := s.AuditEvents(storage.AuditQuery{Since: time.Now().Add(time.Hour)}); err != nil || len(events) != 0 {
+		t.Errorf("AuditEvents in the future = %d, %v, want none", len(events), err)
+	}
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	a, b := storage.TokenFingerprint("token-a"), storage.TokenFingerprint("token-b")
+	if a == b || len(a) != 16 || a != storage.TokenFingerprint("token-a") || strings.Contains(a, "token") {
+		t.Errorf("TokenFingerprint = %q and %q", a, b)
+	}
+	if _, ok := storage.RequestInfoFromContext(context.Background()); ok {
+		t.Error("RequestInfoFromContext of an empty context reported info")
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import "github.com/gislik/gorm"
+import "github.com/gislik/osin-storage/internal/model"
+import "github.com/openshift/osin"
 import "time"
 
 // Authorize data model
@@ -15,9 +17,54 @@ type Authorize struct {
 	UserData            string    // Data to be passed to storage. Not used by the library.
 	CodeChallenge       string    // Optional code_challenge as described in rfc7636
 	CodeChallengeMethod string    // Optional code_challenge_method as described in rfc7636
+	OpenIDRequest                 // OpenID Connect request parameters
+
+	Client Client `gorm:"save_associations:false" json:"-"` // Client association
 }
 
 // TableName is used by `gorm`
 func (Authorize) TableName(db *gorm.DB) string {
 	return gorm.DefaultTableNameHandler(db, "oauth_authorize")
 }
+
+// ToOsin converts the model to osin.AuthorizeData using client as its client
+func (a *Authorize) ToOsin(client osin.Client) *osin.AuthorizeData {
+	oa := &osin.AuthorizeData{
+		Client:              client,
+		Code:                a.Code,
+		ExpiresIn:           a.ExpiresIn,
+		Scope:               a.Scope,
+		RedirectUri:         a.RedirectUri,
+		State:               a.State,
+		CreatedAt:           a.CreatedAt,
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
+	}
+	oa.UserData = model.JoinUserData(a.OpenIDRequest, a.UserData)
+	return oa
+}
+
+// AuthorizeFromOsin converts osin.AuthorizeData to the model
+func AuthorizeFromOsin(data *osin.AuthorizeData) (Authorize, error) {
+	authorize := Authorize{
+		ClientID:            data.Client.GetId(),
+		Code:                data.Code,
+		ExpiresIn:           data.ExpiresIn,
+		RedirectUri:         data.RedirectUri,
+		Scope:               data.Scope,
+		State:               data.State,
+		CreatedAt:           data.CreatedAt,
+		CodeChallenge:       data.CodeChallenge,
+		CodeChallengeMethod: data.CodeChallengeMethod,
+	}
+	if data.UserData != nil {
+		var userData interface{}
+		authorize.OpenIDRequest, userData = model.SplitUserData(data.UserData)
+		v, err := model.UserDataToString(userData)
+		if err != nil {
+			return authorize, err
+		}
+		authorize.UserData = v
+	}
+	return authorize, nil
+}
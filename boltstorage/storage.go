@@ -0,0 +1,266 @@
+// Package boltstorage implements osin.Storage on an embedded bbolt database file
+// for single node deployments without a SQL server.
+package boltstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	clientBucket    = []byte("oauth_client")
+	authorizeBucket = []byte("oauth_authorize")
+	accessBucket    = []byte("oauth_access")
+	refreshBucket   = []byte("oauth_refresh") // refresh token to access token index
+)
+
+var errExists = errors.New("boltstorage: key already exists")
+
+// Storage keeps clients, authorize and access data in bbolt buckets
+// mirroring the tables of storage.Storage.
+type Storage struct {
+	db *bolt.DB
+
+	// RefreshExpiration is how long access data with a refresh token is kept by Sweep.
+	// Zero keeps it until removed, like storage.Storage.
+	RefreshExpiration time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens or creates the database file at path
+func Open(path string, mode os.FileMode) (*Storage, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{clientBucket, authorizeBucket, accessBucket, refreshBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{db: db}, nil
+}
+
+// Clone the storage if needed.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close is called by osin after each request and does nothing, see Release
+func (s *Storage) Close() {
+}
+
+// Release stops the sweeper and closes the database file
+func (s *Storage) Release() error {
+	s.StopSweeper()
+	return s.db.Close()
+}
+
+// GetClient loads the client by id (client_id)
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var c storage.Client
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return get(tx, clientBucket, id, &c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.ToOsin(), nil
+}
+
+// SaveClient saves client
+func (s *Storage) SaveClient(c osin.Client) error {
+	client, err := storage.ClientFromOsin(c)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, clientBucket, client.ID, &client)
+	})
+}
+
+// RemoveClient removes the client with matching id
+func (s *Storage) RemoveClient(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return del(tx, clientBucket, id)
+	})
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	authorize, err := storage.AuthorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, authorizeBucket, authorize.Code, &authorize)
+	})
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var data *osin.AuthorizeData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var a storage.Authorize
+		var c storage.Client
+		if err := get(tx, authorizeBucket, code, &a); err != nil {
+			return err
+		}
+		if err := get(tx, clientBucket, a.ClientID, &c); err != nil {
+			return err
+		}
+		data = a.ToOsin(c.ToOsin())
+		return nil
+	})
+	return data, err
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return del(tx, authorizeBucket, code)
+	})
+}
+
+// SaveAccess writes AccessData and indexes its refresh token.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	access, err := storage.AccessFromOsin(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := put(tx, accessBucket, access.AccessToken, &access); err != nil {
+			return err
+		}
+		if access.RefreshToken == "" {
+			return nil
+		}
+		return tx.Bucket(refreshBucket).Put([]byte(access.RefreshToken), []byte(access.AccessToken))
+	})
+}
+
+// LoadAccess retrieves access data by token.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	var data *osin.AccessData
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		data, err = loadAccess(tx, code)
+		return err
+	})
+	return data, err
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *Storage) RemoveAccess(code string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeAccess(tx, code)
+	})
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	var data *osin.AccessData
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		token := tx.Bucket(refreshBucket).Get([]byte(code))
+		if token == nil {
+			return gorm.ErrRecordNotFound
+		}
+		data, err = loadAccess(tx, string(token))
+		return err
+	})
+	return data, err
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *Storage) RemoveRefresh(code string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		token := tx.Bucket(refreshBucket).Get([]byte(code))
+		if token == nil {
+			return storage.ErrNotFound
+		}
+		return removeAccess(tx, string(token))
+	})
+}
+
+func loadAccess(tx *bolt.Tx, token string) (*osin.AccessData, error) {
+	var a storage.Access
+	var c storage.Client
+	if err := get(tx, accessBucket, token, &a); err != nil {
+		return nil, err
+	}
+	if err := get(tx, clientBucket, a.ClientID, &c); err != nil {
+		return nil, err
+	}
+	client := c.ToOsin()
+	oa := a.ToOsin(client)
+	if a.Authorize != "" {
+		var authorize storage.Authorize
+		if err := get(tx, authorizeBucket, a.Authorize, &authorize); err == nil && authorize.ClientID == a.ClientID {
+			oa.AuthorizeData = authorize.ToOsin(client)
+		}
+	}
+	return oa, nil
+}
+
+func removeAccess(tx *bolt.Tx, token string) error {
+	var a storage.Access
+	if err := get(tx, accessBucket, token, &a); err == gorm.ErrRecordNotFound {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if a.RefreshToken != "" {
+		if err := tx.Bucket(refreshBucket).Delete([]byte(a.RefreshToken)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(accessBucket).Delete([]byte(token))
+}
+
+// get decodes the value of key in bucket into v.
+// A missing key is reported as gorm.ErrRecordNotFound like storage.Storage does.
+func get(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	b := tx.Bucket(bucket).Get([]byte(key))
+	if b == nil {
+		return gorm.ErrRecordNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+// put stores v under key in bucket unless key exists
+func put(tx *bolt.Tx, bucket []byte, key string, v interface{}) error {
+	b := tx.Bucket(bucket)
+	if b.Get([]byte(key)) != nil {
+		return errExists
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// del removes key from bucket, returning storage.ErrNotFound when it did not exist
+func del(tx *bolt.Tx, bucket []byte, key string) error {
+	b := tx.Bucket(bucket)
+	if b.Get([]byte(key)) == nil {
+		return storage.ErrNotFound
+	}
+	return b.Delete([]byte(key))
+}
@@ -0,0 +1,74 @@
+package boltstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		s, err := Open(filepath.Join(t.TempDir(), "oauth.db"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Release() })
+		return s
+	})
+}
+
+func TestSweep(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "oauth.db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+	s.RefreshExpiration = time.Hour
+
+	client := &osin.DefaultClient{Id: "sweep", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for code, createdAt := range map[string]time.Time{"expired": now.Add(-time.Hour), "live": now} {
+		data := &osin.AuthorizeData{Client: client, Code: code, ExpiresIn: 600, RedirectUri: client.RedirectUri, CreatedAt: createdAt}
+		if err := s.SaveAuthorize(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, data := range []*osin.AccessData{
+		{Client: client, AccessToken: "expired-access", ExpiresIn: 600, CreatedAt: now.Add(-time.Hour)},
+		{Client: client, AccessToken: "live-access", ExpiresIn: 600, CreatedAt: now},
+		{Client: client, AccessToken: "expired-refresh", RefreshToken: "refresh-1", ExpiresIn: 600, CreatedAt: now.Add(-2 * time.Hour)},
+		{Client: client, AccessToken: "live-refresh", RefreshToken: "refresh-2", ExpiresIn: 600, CreatedAt: now.Add(-time.Hour + time.Minute)},
+	} {
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := s.Sweep(); err != nil || n != 3 {
+		t.Fatalf("Sweep = %d, %v, want 3", n, err)
+	}
+	if _, err := s.LoadAuthorize("expired"); err == nil {
+		t.Error("expired authorize data kept")
+	}
+	if _, err := s.LoadAuthorize("live"); err != nil {
+		t.Errorf("live authorize data removed: %v", err)
+	}
+	if _, err := s.LoadAccess("expired-access"); err == nil {
+		t.Error("expired access data kept")
+	}
+	if _, err := s.LoadAccess("live-access"); err != nil {
+		t.Errorf("live access data removed: %v", err)
+	}
+	if _, err := s.LoadRefresh("refresh-1"); err == nil {
+		t.Error("expired refresh token kept")
+	}
+	if _, err := s.LoadRefresh("refresh-2"); err != nil {
+		t.Errorf("refresh token within RefreshExpiration removed: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package boltstorage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Sweep deletes expired authorize data and expired access data.
+// Access data with a refresh token is only deleted once RefreshExpiration passed.
+// It returns the number of deleted entries.
+func (s *Storage) Sweep() (int, error) {
+	now := time.Now()
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(authorizeBucket).ForEach(func(k, v []byte) error {
+			var a storage.Authorize
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if expiresAt(a.CreatedAt, a.ExpiresIn).Before(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(authorizeBucket).Delete(k); err != nil {
+				return err
+			}
+			n++
+		}
+
+		var tokens []string
+		err = tx.Bucket(accessBucket).ForEach(func(k, v []byte) error {
+			var a storage.Access
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if a.RefreshToken != "" {
+				if s.RefreshExpiration > 0 && a.CreatedAt.Add(s.RefreshExpiration).Before(now) {
+					tokens = append(tokens, a.AccessToken)
+				}
+			} else if expiresAt(a.CreatedAt, a.ExpiresIn).Before(now) {
+				tokens = append(tokens, a.AccessToken)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if err := removeAccess(tx, token); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// StartSweeper runs Sweep every interval until StopSweeper or Release is called.
+// Sweep errors are passed to onError when it is not nil.
+func (s *Storage) StartSweeper(interval time.Duration, onError func(error)) {
+	s.StopSweeper()
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Sweep(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop)
+}
+
+// StopSweeper stops the sweeper started by StartSweeper
+func (s *Storage) StopSweeper() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	s.stop = nil
+}
+
+func expiresAt(createdAt time.Time, expiresIn int32) time.Time {
+	return createdAt.Add(time.Duration(expiresIn) * time.Second)
+}
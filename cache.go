@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is the interface used by CachingStorage to hold loaded entities.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key and whether it was found
+	Get(key string) (interface{}, bool)
+	// Set stores value under key for at most ttl. A zero ttl uses the cache default
+	Set(key string, value interface{}, ttl time.Duration)
+	// Delete removes key from the cache
+	Delete(key string)
+	// Purge removes every entry from the cache
+	Purge()
+}
+
+type lruEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// LRUCache is an in-memory Cache evicting the least recently used entry
+// once size is reached. Entries also expire after their ttl.
+type LRUCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// NewLRUCache returns a LRUCache holding at most size entries, each for at most ttl
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key and whether it was found
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expiresAt) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Set stores value under key for at most ttl. A zero ttl uses the cache default
+func (c *LRUCache) Set(key string, value interface{}, ttl time.Duration) {
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value = value
+		e.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.size > 0 && c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete removes key from the cache
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge removes every entry from the cache
+func (c *LRUCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/openshift/osin"
+)
+
+const (
+	clientCacheKey  = "client:"
+	accessCacheKey  = "access:"
+	refreshCacheKey = "refresh:"
+)
+
+// notFound is cached in place of an entity that is missing from the database
+type notFound struct{}
+
+// CachingStorage is a read-through cache in front of Storage.
+// GetClient, LoadAccess and LoadRefresh are served from the cache when possible,
+// unknown ids and tokens are cached as well for NegativeTTL.
+type CachingStorage struct {
+	storage *Storage
+	cache   Cache
+
+	// NegativeTTL is how long a missing client or token is remembered
+	NegativeTTL time.Duration
+}
+
+// NewCachingStorage wraps s with cache. A nil cache uses an LRUCache of 1024 entries kept for a minute.
+func NewCachingStorage(s *Storage, cache Cache) *CachingStorage {
+	if cache == nil {
+		cache = NewLRUCache(1024, time.Minute)
+	}
+	return &CachingStorage{
+		storage:     s,
+		cache:       cache,
+		NegativeTTL: 5 * time.Second,
+	}
+}
+
+// Clone the storage if needed.
+func (s *CachingStorage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds
+func (s *CachingStorage) Close() {
+	s.storage.Close()
+}
+
+// GetClient loads the client by id (client_id)
+func (s *CachingStorage) GetClient(id string) (osin.Client, error) {
+	key := clientCacheKey + id
+	if v, ok := s.cache.Get(key); ok {
+		if c, ok := v.(osin.Client); ok {
+			return c, nil
+		}
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	c, err := s.storage.GetClient(id)
+	if err != nil {
+		s.setNotFound(key, err)
+		return nil, err
+	}
+	s.cache.Set(key, c, 0)
+	return c, nil
+}
+
+// SaveClient saves client
+func (s *CachingStorage) SaveClient(c osin.Client) error {
+	defer s.cache.Delete(clientCacheKey + c.GetId())
+	return s.storage.SaveClient(c)
+}
+
+// RemoveClient removes the client with matching id.
+// Cached tokens embed their client so the whole cache is purged.
+func (s *CachingStorage) RemoveClient(id string) error {
+	defer s.cache.Purge()
+	return s.storage.RemoveClient(id)
+}
+
+// RevokeByScope removes the access data having scope.
+// Cached tokens are not indexed by scope so the whole cache is purged.
+func (s *CachingStorage) RevokeByScope(scope string) (int64, error) {
+	defer s.cache.Purge()
+	return s.storage.RevokeByScope(scope)
+}
+
+// SaveAuthorize saves authorize data.
+func (s *CachingStorage) SaveAuthorize(data *osin.AuthorizeData) error {
+	return s.storage.SaveAuthorize(data)
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *CachingStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	return s.storage.LoadAuthorize(code)
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *CachingStorage) RemoveAuthorize(code string) error {
+	return s.storage.RemoveAuthorize(code)
+}
+
+// SaveAccess writes AccessData.
+// JWT access tokens are evicted by their jti, the key LoadRefresh caches them under.
+func (s *CachingStorage) SaveAccess(data *osin.AccessData) error {
+	defer func() {
+		s.cache.Delete(accessKey(data.AccessToken))
+		if data.RefreshToken != "" {
+			s.cache.Delete(refreshCacheKey + data.RefreshToken)
+		}
+	}()
+	return s.storage.SaveAccess(data)
+}
+
+// LoadAccess retrieves access data by token.
+// JWT access tokens are verified by Storage on each call and not cached.
+func (s *CachingStorage) LoadAccess(code string) (*osin.AccessData, error) {
+	if isJWT(code) {
+		return s.storage.LoadAccess(code)
+	}
+	key := accessCacheKey + code
+	if v, ok := s.cache.Get(key); ok {
+		if a, ok := v.(*osin.AccessData); ok {
+			return copyAccess(a), nil
+		}
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	a, err := s.storage.LoadAccess(code)
+	if err != nil {
+		s.setNotFound(key, err)
+		return nil, err
+	}
+	s.setAccess(a)
+	return copyAccess(a), nil
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+// JWT access tokens are evicted by their jti, the key LoadRefresh caches them under.
+func (s *CachingStorage) RemoveAccess(code string) error {
+	key := accessKey(code)
+	if v, ok := s.cache.Get(key); ok {
+		if a, ok := v.(*osin.AccessData); ok && a.RefreshToken != "" {
+			defer s.cache.Delete(refreshCacheKey + a.RefreshToken)
+		}
+	}
+	defer s.cache.Delete(key)
+	return s.storage.RemoveAccess(code)
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *CachingStorage) LoadRefresh(code string) (*osin.AccessData, error) {
+	key := refreshCacheKey + code
+	if v, ok := s.cache.Get(key); ok {
+		if token, ok := v.(string); ok {
+			return s.LoadAccess(token)
+		}
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	a, err := s.storage.LoadRefresh(code)
+	if err != nil {
+		s.setNotFound(key, err)
+		return nil, err
+	}
+	s.setAccess(a)
+	return copyAccess(a), nil
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+// The access data sharing the refresh token is evicted as well.
+func (s *CachingStorage) RemoveRefresh(code string) error {
+	key := refreshCacheKey + code
+	if v, ok := s.cache.Get(key); ok {
+		if token, ok := v.(string); ok {
+			defer s.cache.Delete(accessCacheKey + token)
+		}
+	} else if a, err := s.storage.LoadRefresh(code); err == nil {
+		defer s.cache.Delete(accessCacheKey + a.AccessToken)
+	}
+	defer s.cache.Delete(key)
+	return s.storage.RemoveRefresh(code)
+}
+
+// accessKey returns the cache key of the access token, the jti of JWT access tokens
+func accessKey(token string) string {
+	if id, err := accessTokenID(token); err == nil {
+		return accessCacheKey + id
+	}
+	return accessCacheKey + token
+}
+
+// setAccess caches a under its access and refresh token,
+// never for longer than the access token lives.
+func (s *CachingStorage) setAccess(a *osin.AccessData) {
+	ttl := time.Until(a.ExpireAt())
+	if ttl <= 0 {
+		return
+	}
+	s.cache.Set(accessCacheKey+a.AccessToken, a, ttl)
+	if a.RefreshToken != "" {
+		s.cache.Set(refreshCacheKey+a.RefreshToken, a.AccessToken, ttl)
+	}
+}
+
+// copyAccess returns a shallow copy of a, so callers changing the access data they loaded
+// do not change the cached entry shared with other requests
+func copyAccess(a *osin.AccessData) *osin.AccessData {
+	c := *a
+	return &c
+}
+
+// setNotFound remembers key as missing. Other errors are not cached.
+func (s *CachingStorage) setNotFound(key string, err error) {
+	if err == gorm.ErrRecordNotFound && s.NegativeTTL > 0 {
+		s.cache.Set(key, notFound{}, s.NegativeTTL)
+	}
+}
@@ -0,0 +1,121 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// newCachingStorage returns a caching storage, the storage it wraps and a saved client
+func newCachingStorage(t *testing.T) (*storage.CachingStorage, *storage.Storage, osin.Client) {
+	s := storage.NewStorage(storagetest.OpenDB(t))
+	client := &osin.DefaultClient{Id: "cached", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewCachingStorage(s, nil), s, client
+}
+
+func newCachedAccess(client osin.Client, token string) *osin.AccessData {
+	return &osin.AccessData{
+		Client:       client,
+		AccessToken:  token,
+		RefreshToken: token + "-refresh",
+		ExpiresIn:    3600,
+		Scope:        "read",
+		CreatedAt:    time.Now(),
+	}
+}
+
+func TestCachingStorageNegative(t *testing.T) {
+	cs, s, client := newCachingStorage(t)
+
+	if _, err := cs.LoadAccess("behind"); err == nil {
+		t.Fatal("LoadAccess of a missing token succeeded")
+	}
+	if err := s.SaveAccess(newCachedAccess(client, "behind")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LoadAccess("behind"); err == nil {
+		t.Error("LoadAccess within NegativeTTL did not serve the cached miss")
+	}
+
+	if _, err := cs.LoadAccess("saved"); err == nil {
+		t.Fatal("LoadAccess of a missing token succeeded")
+	}
+	if err := cs.SaveAccess(newCachedAccess(client, "saved")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LoadAccess("saved"); err != nil {
+		t.Errorf("LoadAccess after SaveAccess: %v, the cached miss was not evicted", err)
+	}
+}
+
+func TestCachingStorageRemove(t *testing.T) {
+	cs, _, client := newCachingStorage(t)
+	data := newCachedAccess(client, "removed")
+	if err := cs.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LoadAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LoadRefresh(data.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.RemoveAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LoadAccess(data.AccessToken); err == nil {
+		t.Error("LoadAccess after RemoveAccess served the cached entry")
+	}
+	if _, err := cs.LoadRefresh(data.RefreshToken); err == nil {
+		t.Error("LoadRefresh after RemoveAccess served the cached entry")
+	}
+}
+
+func TestCachingStorageCopies(t *testing.T) {
+	cs, _, client := newCachingStorage(t)
+	if err := cs.SaveAccess(newCachedAccess(client, "copied")); err != nil {
+		t.Fatal(err)
+	}
+	for _, load := range []func() (*osin.AccessData, error){
+		func() (*osin.AccessData, error) { return cs.LoadAccess("copied") },
+		func() (*osin.AccessData, error) { return cs.LoadRefresh("copied-refresh") },
+	} {
+		a, err := load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Scope = "changed"
+		if b, err := cs.LoadAccess("copied"); err != nil || b.Scope != "read" {
+			t.Errorf("LoadAccess after changing a loaded copy = %v, %v, want scope read", b, err)
+		}
+	}
+}
+
+func TestCachingStorageSaveJWT(t *testing.T) {
+	s, _, gen, client := newJWTStorage(t)
+	cs := storage.NewCachingStorage(s, nil)
+	data := issue(t, s, gen, client, 3600)
+
+	// LoadRefresh caches the access data under the jti
+	cached, err := cs.LoadRefresh(data.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jti := cached.AccessToken
+	if err := s.RemoveAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	data.Scope = "write"
+	if err := cs.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := cs.LoadAccess(jti); err != nil || a.Scope != "write" {
+		t.Errorf("LoadAccess by jti after SaveAccess = %v, %v, want the saved scope", a, err)
+	}
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
 )
 
 //Client model
@@ -16,3 +18,30 @@ type Client struct {
 func (Client) TableName(db *gorm.DB) string {
 	return gorm.DefaultTableNameHandler(db, "oauth_client")
 }
+
+// ToOsin converts the model to an osin.Client
+func (c *Client) ToOsin() osin.Client {
+	return &osin.DefaultClient{
+		Id:          c.ID,
+		Secret:      c.Secret,
+		RedirectUri: c.RedirectUri,
+		UserData:    c.UserData,
+	}
+}
+
+// ClientFromOsin converts an osin.Client to the model
+func ClientFromOsin(c osin.Client) (Client, error) {
+	client := Client{
+		ID:          c.GetId(),
+		Secret:      c.GetSecret(),
+		RedirectUri: c.GetRedirectUri(),
+	}
+	if c.GetUserData() != nil {
+		v, err := model.UserDataToString(c.GetUserData())
+		if err != nil {
+			return client, err
+		}
+		client.UserData = v
+	}
+	return client, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+)
+
+// Consent model, the scopes a user granted to a client
+type Consent struct {
+	Subject   string    `gorm:"primary_key"` // End-user who consented
+	ClientID  string    `gorm:"primary_key"` // Client information
+	Scope     string    // Granted scopes, space delimited and sorted
+	CreatedAt time.Time // Date of the first grant
+	UpdatedAt time.Time // Date of the last grant or partial revocation
+}
+
+// TableName is used by `gorm`
+func (Consent) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_consent")
+}
+
+// Covers reports whether every scope of the space delimited scope was granted
+func (c *Consent) Covers(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !hasScope(c.Scope, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// ConsentStore remembers the scopes users consented to in the oauth_consent table,
+// so returning users can skip the consent screen.
+type ConsentStore struct {
+	db *gorm.DB
+}
+
+// NewConsentStore returns a ConsentStore on db
+func NewConsentStore(db *gorm.DB) *ConsentStore {
+	return &ConsentStore{db: db}
+}
+
+// upsertOptions returns the insert option leaving an existing row alone and
+// the query option locking the selected rows for the dialect of db
+func upsertOptions(db *gorm.DB) (insert, lock string) {
+	switch db.Dialect().GetName() {
+	case "mysql":
+		return "ON DUPLICATE KEY UPDATE subject = subject", "FOR UPDATE"
+	case "sqlite3":
+		// sqlite serializes writers, it has no row locks. ON CONFLICT needs sqlite 3.24 or later
+		return "ON CONFLICT DO NOTHING", ""
+	default:
+		return "ON CONFLICT DO NOTHING", "FOR UPDATE"
+	}
+}
+
+// Grant records that subject consented to scope for clientID, adding to the scopes granted before.
+// The consent is upserted and locked, so concurrent grants add up instead of failing or overwriting each other.
+func (cs *ConsentStore) Grant(subject, clientID, scope string) error {
+	insert, lock := upsertOptions(cs.db)
+	tx := cs.db.Begin()
+	err := tx.Set("gorm:insert_option", insert).Create(&Consent{Subject: subject, ClientID: clientID}).Error
+	var c Consent
+	if err == nil {
+		err = tx.Set("gorm:query_option", lock).Where("subject = ? AND client_id = ?", subject, clientID).First(&c).Error
+	}
+	if err == nil {
+		err = tx.Model(&c).Update("scope", model.NormalizeScope(c.Scope+" "+scope)).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Lookup loads the consent of subject for clientID
+func (cs *ConsentStore) Lookup(subject, clientID string) (*Consent, error) {
+	var c Consent
+	if err := cs.db.Where("subject = ? AND client_id = ?", subject, clientID).First(&c).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Covers reports whether subject already consented to every scope of scope for clientID
+func (cs *ConsentStore) Covers(subject, clientID, scope string) (bool, error) {
+	c, err := cs.Lookup(subject, clientID)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return c.Covers(scope), nil
+}
+
+// Revoke withdraws the scopes of scope granted by subject to clientID, all of them when scope is empty.
+// ErrNotFound is returned when subject did not consent to clientID.
+func (cs *ConsentStore) Revoke(subject, clientID, scope string) error {
+	if scope == "" {
+		return affected(cs.db.Where("subject = ? AND client_id = ?", subject, clientID).Delete(&Consent{}))
+	}
+	_, lock := upsertOptions(cs.db)
+	tx := cs.db.Begin()
+	var c Consent
+	if err := tx.Set("gorm:query_option", lock).Where("subject = ? AND client_id = ?", subject, clientID).First(&c).Error; err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+	var kept []string
+	for _, s := range strings.Fields(c.Scope) {
+		if !hasScope(scope, s) {
+			kept = append(kept, s)
+		}
+	}
+	var err error
+	if len(kept) == 0 {
+		err = tx.Delete(&c).Error
+	} else {
+		err = tx.Model(&c).Update("scope", strings.Join(kept, " ")).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// List returns the consents of subject
+func (cs *ConsentStore) List(subject string) ([]Consent, error) {
+	var consents []Consent
+	if err := cs.db.Where("subject = ?", subject).Order("client_id").Find(&consents).Error; err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
@@ -0,0 +1,71 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+)
+
+func TestConsentStore(t *testing.T) {
+	consents := storage.NewConsentStore(storagetest.OpenDB(t))
+
+	if err := consents.Grant("user", "client-b", "write read"); err != nil {
+		t.Fatalf("first Grant: %v", err)
+	}
+	if err := consents.Grant("user", "client-b", "admin  read"); err != nil {
+		t.Fatalf("second Grant: %v", err)
+	}
+	c, err := consents.Lookup("user", "client-b")
+	if err != nil || c.Scope != "admin read write" {
+		t.Fatalf("Lookup = %v, %v, want the merged and normalized scope", c, err)
+	}
+
+	for scope, want := range map[string]bool{"read": true, "write read": true, "": true, "read delete": false, "delete": false} {
+		if covered, err := consents.Covers("user", "client-b", scope); err != nil || covered != want {
+			t.Errorf("Covers(%q) = %v, %v, want %v", scope, covered, err, want)
+		}
+	}
+	if covered, err := consents.Covers("user", "missing", "read"); err != nil || covered {
+		t.Errorf("Covers without consent = %v, %v, want false", covered, err)
+	}
+
+	if err := consents.Grant("user", "client-a", "read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := consents.Grant("other", "client-a", "read"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := consents.List("user")
+	if err != nil || len(list) != 2 || list[0].ClientID != "client-a" || list[1].ClientID != "client-b" {
+		t.Fatalf("List = %v, %v, want client-a then client-b", list, err)
+	}
+
+	if err := consents.Revoke("user", "client-b", "admin write"); err != nil {
+		t.Fatalf("partial Revoke: %v", err)
+	}
+	if c, err := consents.Lookup("user", "client-b"); err != nil || c.Scope != "read" {
+		t.Errorf("Lookup after partial Revoke = %v, %v, want read", c, err)
+	}
+	if err := consents.Revoke("user", "client-b", "read"); err != nil {
+		t.Fatalf("Revoke of the last scope: %v", err)
+	}
+	if _, err := consents.Lookup("user", "client-b"); err == nil {
+		t.Error("consent kept after revoking its last scope")
+	}
+	if err := consents.Revoke("user", "client-a", ""); err != nil {
+		t.Fatalf("full Revoke: %v", err)
+	}
+	if list, err := consents.List("user"); err != nil || len(list) != 0 {
+		t.Errorf("List after Revoke = %v, %v, want none", list, err)
+	}
+	if list, err := consents.List("other"); err != nil || len(list) != 1 {
+		t.Errorf("List of another user = %v, %v, want its consent kept", list, err)
+	}
+
+	for _, scope := range []string{"", "read"} {
+		if err := consents.Revoke("user", "client-a", scope); err != storage.ErrNotFound {
+			t.Errorf("Revoke(%q) of missing consent = %v, want ErrNotFound", scope, err)
+		}
+	}
+}
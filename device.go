@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// DeviceCodeGrantType is the grant_type of device access token requests as described in rfc8628
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Status of a DeviceCode
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceCode model, a device authorization request as described in rfc8628
+type DeviceCode struct {
+	DeviceCode   string     `gorm:"primary_key"`  // Device verification code
+	UserCode     string     `gorm:"unique_index"` // End-user verification code, without separator
+	ClientID     string     // Client information
+	Scope        string     // Requested scope
+	Interval     int32      // Minimum polling interval in seconds
+	Status       string     // pending, approved or denied
+	ExpiresIn    int32      // Code expiration in seconds
+	CreatedAt    time.Time  // Date created
+	LastPolledAt *time.Time // Date of the last token request
+	UserData     string     // Data set on approval, passed to the issued access data
+}
+
+// TableName is used by `gorm`
+func (DeviceCode) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_device_code")
+}
+
+// IsExpired reports whether the device code expired
+func (d *DeviceCode) IsExpired() bool {
+	return time.Now().After(d.CreatedAt.Add(time.Duration(d.ExpiresIn) * time.Second))
+}
+
+// FormattedUserCode returns the user code as shown to the end-user, e.g. WDJB-MJHT
+func (d *DeviceCode) FormattedUserCode() string {
+	if len(d.UserCode) != 8 {
+		return d.UserCode
+	}
+	return d.UserCode[:4] + "-" + d.UserCode[4:]
+}
+
+// randomUserCode generates a user code of 8 consonants, avoiding ambiguous characters as suggested by rfc8628
+func randomUserCode() (string, error) {
+	b := make([]byte, 8)
+	buf := make([]byte, 16)
+	for i := 0; i < len(b); {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			// 240 is the largest multiple of 20 below 256
+			if c >= 240 {
+				continue
+			}
+			b[i] = userCodeAlphabet[c%20]
+			i++
+			if i == len(b) {
+				break
+			}
+		}
+	}
+	return string(b), nil
+}
+
+// normalizeUserCode removes separators and whitespace from a user code typed by the end-user
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// NewDeviceCode generates a pending device code for client
+func NewDeviceCode(clientID, scope string, expiresIn, interval int32) (*DeviceCode, error) {
+	deviceCode, err := NewToken(DeviceCodePrefix)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceCode{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientID:   clientID,
+		Scope:      scope,
+		Interval:   interval,
+		Status:     DevicePending,
+		ExpiresIn:  expiresIn,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// SaveDeviceCode saves a device code
+func (s *Storage) SaveDeviceCode(d *DeviceCode) error {
+	return s.db.Create(d).Error
+}
+
+// LoadDeviceCode loads the device code by its device_code
+func (s *Storage) LoadDeviceCode(code string) (*DeviceCode, error) {
+	var d DeviceCode
+	if err := s.db.Where("device_code = ?", code).First(&d).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// LoadDeviceCodeByUserCode loads the device code by the user_code typed by the end-user
+func (s *Storage) LoadDeviceCodeByUserCode(userCode string) (*DeviceCode, error) {
+	var d DeviceCode
+	if err := s.db.Where("user_code = ?", normalizeUserCode(userCode)).First(&d).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ApproveDeviceCode approves the pending device code with userCode.
+// userData is passed to the access data issued to the device.
+func (s *Storage) ApproveDeviceCode(userCode string, userData interface{}) error {
+	v, err := model.UserDataToString(userData)
+	if err != nil {
+		return err
+	}
+	return s.setDeviceStatus(userCode, map[string]interface{}{"status": DeviceApproved, "user_data": v})
+}
+
+// DenyDeviceCode denies the pending device code with userCode
+func (s *Storage) DenyDeviceCode(userCode string) error {
+	return s.setDeviceStatus(userCode, map[string]interface{}{"status": DeviceDenied})
+}
+
+// RemoveDeviceCode removes the device code
+func (s *Storage) RemoveDeviceCode(code string) error {
+	return s.remove(s.db.Where("device_code = ?", code).Delete(&DeviceCode{}))
+}
+
+func (s *Storage) setDeviceStatus(userCode string, fields map[string]interface{}) error {
+	return affected(s.db.Model(&DeviceCode{}).Where("user_code = ? AND status = ?", normalizeUserCode(userCode), DevicePending).Updates(fields))
+}
+
+// affected returns ErrNotFound when db changed no row. Unlike remove it ignores IdempotentRemove,
+// it guards one-time use.
+func affected(db *gorm.DB) error {
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// pollDeviceCode records a token request for the device code and
+// reports whether it came sooner than the polling interval, which is then increased.
+func (s *Storage) pollDeviceCode(d *DeviceCode) (bool, error) {
+	now := time.Now()
+	fields := map[string]interface{}{"last_polled_at": now}
+	tooFast := d.LastPolledAt != nil && now.Before(d.LastPolledAt.Add(time.Duration(d.Interval)*time.Second))
+	if tooFast {
+		// rfc8628 section 3.5, the interval must be increased by 5 seconds on slow_down
+		fields["interval"] = d.Interval + 5
+	}
+	return tooFast, s.db.Model(&DeviceCode{}).Where("device_code = ?", d.DeviceCode).Updates(fields).Error
+}
+
+// DeviceConfig configures the device authorization handlers
+type DeviceConfig struct {
+	VerificationURI string // URL of the DeviceVerificationHandler shown to the end-user
+	Expiration      int32  // Device code expiration in seconds, 600 when zero
+	Interval        int32  // Polling interval in seconds, 5 when zero
+}
+
+// DeviceAuthorizationHandler serves the device authorization endpoint of rfc8628.
+// Confidential clients authenticate with HTTP basic or client_secret, public clients send client_id only.
+func DeviceAuthorizationHandler(s *Storage, config DeviceConfig) http.Handler {
+	if config.Expiration == 0 {
+		config.Expiration = 600
+	}
+	if config.Interval == 0 {
+		config.Interval = 5
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		client, ok := authenticateClient(s, r)
+		if !ok {
+			writeOAuthError(w, http.StatusUnauthorized, osin.E_INVALID_CLIENT)
+			return
+		}
+		d, err := NewDeviceCode(client.GetId(), r.PostFormValue("scope"), config.Expiration, config.Interval)
+		if err == nil {
+			err = s.SaveDeviceCode(d)
+		}
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, osin.E_SERVER_ERROR)
+			return
+		}
+		out := map[string]interface{}{
+			"device_code":      d.DeviceCode,
+			"user_code":        d.FormattedUserCode(),
+			"verification_uri": config.VerificationURI,
+			"expires_in":       d.ExpiresIn,
+			"interval":         d.Interval,
+		}
+		if uri := verificationURIComplete(config.VerificationURI, d.FormattedUserCode()); uri != "" {
+			out["verification_uri_complete"] = uri
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+// verificationURIComplete returns the verification URI carrying userCode, empty when the URI does not parse
+func verificationURIComplete(uri, userCode string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("user_code", userCode)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// DeviceCSRFField is the form field carrying the anti-CSRF token of DeviceVerificationHandler
+const DeviceCSRFField = "csrf_token"
+
+// deviceCSRFCookie holds the anti-CSRF token the form field must match
+const deviceCSRFCookie = "device_csrf"
+
+// DeviceCSRFToken returns the anti-CSRF token of r. Login pages written by the authenticate function
+// of DeviceVerificationHandler must post it back in the DeviceCSRFField field.
+func DeviceCSRFToken(r *http.Request) string {
+	if c, err := r.Cookie(deviceCSRFCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// deviceCSRF returns the anti-CSRF token of r, setting a new one on w when r has none
+func deviceCSRF(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := DeviceCSRFToken(r); token != "" {
+		return token, nil
+	}
+	b := make([]byte, tokenSecretLen)
+	if err := randomBase62(b); err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCSRFCookie,
+		Value:    string(b),
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return string(b), nil
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<html><body>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Form}}<form method="POST">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>Code <input type="text" name="user_code" value="{{.UserCode}}"></label>
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>{{end}}
+</body></html>`))
+
+// DeviceVerificationHandler serves the page where the end-user enters the user code shown by the device.
+// authenticate is called once a valid pending code was entered, it returns the UserData of the
+// issued access data or false after writing a login page, like example.HandleLoginPage.
+// Posts must carry the anti-CSRF token of the page in the DeviceCSRFField field, see DeviceCSRFToken.
+func DeviceVerificationHandler(s *Storage, authenticate func(w http.ResponseWriter, r *http.Request, d *DeviceCode) (interface{}, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := struct {
+			Message   string
+			Form      bool
+			UserCode  string
+			CSRFToken string
+		}{Form: true, UserCode: r.FormValue("user_code")}
+
+		var err error
+		if page.CSRFToken, err = deviceCSRF(w, r); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if page.UserCode == "" || r.Method != "POST" {
+			deviceTemplate.Execute(w, &page)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue(DeviceCSRFField)), []byte(DeviceCSRFToken(r))) != 1 {
+			page.Message = "The form expired, please submit it again."
+			w.WriteHeader(http.StatusForbidden)
+			deviceTemplate.Execute(w, &page)
+			return
+		}
+		d, err := s.LoadDeviceCodeByUserCode(page.UserCode)
+		if err != nil || d.Status != DevicePending || d.IsExpired() {
+			page.Message = "The code is invalid or expired."
+			w.WriteHeader(http.StatusBadRequest)
+			deviceTemplate.Execute(w, &page)
+			return
+		}
+		userData, ok := authenticate(w, r, d)
+		if !ok {
+			return
+		}
+
+		page.Form = false
+		if r.FormValue("action") == "deny" {
+			err = s.DenyDeviceCode(d.UserCode)
+			page.Message = "The device was denied access."
+		} else {
+			err = s.ApproveDeviceCode(d.UserCode, userData)
+			page.Message = "The device was approved, you can return to it."
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		deviceTemplate.Execute(w, &page)
+	})
+}
+
+// HandleDeviceAccessRequest answers token requests with the device_code grant type and reports
+// whether it did. Other requests are left to osin. Approved device codes are exchanged once
+// for access data generated by server.AccessTokenGen and saved with SaveAccess, with a refresh token
+// when server allows the refresh_token grant.
+func HandleDeviceAccessRequest(server *osin.Server, s *Storage, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" || r.PostFormValue("grant_type") != DeviceCodeGrantType {
+		return false
+	}
+	client, ok := authenticateClient(s, r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, osin.E_INVALID_CLIENT)
+		return true
+	}
+	d, err := s.LoadDeviceCode(r.PostFormValue("device_code"))
+	if err != nil || d.ClientID != client.GetId() {
+		writeOAuthError(w, http.StatusBadRequest, osin.E_INVALID_GRANT)
+		return true
+	}
+	if d.IsExpired() {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token")
+		return true
+	}
+	tooFast, err := s.pollDeviceCode(d)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, osin.E_SERVER_ERROR)
+		return true
+	}
+	switch {
+	case d.Status == DeviceDenied:
+		writeOAuthError(w, http.StatusBadRequest, osin.E_ACCESS_DENIED)
+		return true
+	case tooFast:
+		writeOAuthError(w, http.StatusBadRequest, "slow_down")
+		return true
+	case d.Status != DeviceApproved:
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending")
+		return true
+	}
+
+	data := &osin.AccessData{
+		Client:    client,
+		ExpiresIn: server.Config.AccessExpiration,
+		Scope:     d.Scope,
+		CreatedAt: time.Now(),
+	}
+	if d.UserData != "" {
+		data.UserData = d.UserData
+	}
+	refresh := server.Config.AllowedAccessTypes.Exists(osin.REFRESH_TOKEN)
+	data.AccessToken, data.RefreshToken, err = server.AccessTokenGen.GenerateAccessToken(data, refresh)
+	if err == nil {
+		// the device code is exchanged only once, it is deleted in the transaction saving the access data
+		err = s.saveAccess(data, func(tx *gorm.DB) error {
+			return affected(tx.Where("device_code = ?", d.DeviceCode).Delete(&DeviceCode{}))
+		})
+	}
+	if err == ErrNotFound {
+		writeOAuthError(w, http.StatusBadRequest, osin.E_INVALID_GRANT)
+		return true
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, osin.E_SERVER_ERROR)
+		return true
+	}
+	out := map[string]interface{}{
+		"access_token": data.AccessToken,
+		"token_type":   server.Config.TokenType,
+		"expires_in":   data.ExpiresIn,
+	}
+	if data.RefreshToken != "" {
+		out["refresh_token"] = data.RefreshToken
+	}
+	if data.Scope != "" {
+		out["scope"] = data.Scope
+	}
+	writeJSON(w, http.StatusOK, out)
+	return true
+}
+
+// authenticateClient authenticates the client of r with HTTP basic or form parameters.
+// Clients without a secret may authenticate with client_id alone.
+func authenticateClient(s osin.Storage, r *http.Request) (osin.Client, bool) {
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id == "" {
+		return nil, false
+	}
+	client, err := s.GetClient(id)
+	if err != nil {
+		return nil, false
+	}
+	if client.GetSecret() != "" && !osin.CheckClientSecret(client, secret) {
+		return nil, false
+	}
+	return client, true
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
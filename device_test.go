@@ -0,0 +1,180 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// deviceFlow is a server answering device authorization and token requests for client
+type deviceFlow struct {
+	db     *gorm.DB
+	s      *storage.Storage
+	server *osin.Server
+	client *osin.DefaultClient
+}
+
+func newDeviceFlow(t *testing.T, accessTypes ...osin.AccessRequestType) *deviceFlow {
+	db := storagetest.OpenDB(t)
+	s := storage.NewStorage(db)
+	client := &osin.DefaultClient{Id: "device", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	config := osin.NewServerConfig()
+	config.AllowedAccessTypes = accessTypes
+	return &deviceFlow{db: db, s: s, server: osin.NewServer(config, s), client: client}
+}
+
+// authorize starts a device authorization and returns the device and the user code
+func (f *deviceFlow) authorize(t *testing.T) (string, string) {
+	req := httptest.NewRequest("POST", "/device_authorization", strings.NewReader(url.Values{"scope": {"read"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(f.client.Id, f.client.Secret)
+	w := httptest.NewRecorder()
+	storage.DeviceAuthorizationHandler(f.s, storage.DeviceConfig{VerificationURI: "http://localhost/device"}).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("device authorization status = %d: %s", w.Code, w.Body)
+	}
+	var out struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.DeviceCode, out.UserCode
+}
+
+// poll sends a token request for deviceCode as if the polling interval had passed
+func (f *deviceFlow) poll(t *testing.T, deviceCode string) (int, map[string]interface{}) {
+	if err := f.db.Model(&storage.DeviceCode{}).Where("device_code = ?", deviceCode).Update("last_polled_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return f.pollNow(t, deviceCode)
+}
+
+// pollNow sends a token request for deviceCode
+func (f *deviceFlow) pollNow(t *testing.T, deviceCode string) (int, map[string]interface{}) {
+	form := url.Values{"grant_type": {storage.DeviceCodeGrantType}, "device_code": {deviceCode}}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(f.client.Id, f.client.Secret)
+	w := httptest.NewRecorder()
+	if !storage.HandleDeviceAccessRequest(f.server, f.s, w, req) {
+		t.Fatal("HandleDeviceAccessRequest did not handle the device code grant")
+	}
+	var out map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, out
+}
+
+// verify posts action for userCode on the verification page, with the anti-CSRF token when csrf is set
+func (f *deviceFlow) verify(t *testing.T, userCode, action string, csrf bool) int {
+	handler := storage.DeviceVerificationHandler(f.s, func(w http.ResponseWriter, r *http.Request, d *storage.DeviceCode) (interface{}, bool) {
+		return "user", true
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/device", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("verification page set cookies %v, want the anti-CSRF cookie", cookies)
+	}
+
+	form := url.Values{"user_code": {userCode}, "action": {action}}
+	if csrf {
+		form.Set(storage.DeviceCSRFField, cookies[0].Value)
+	}
+	req := httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestDeviceFlow(t *testing.T) {
+	f := newDeviceFlow(t, osin.AUTHORIZATION_CODE, osin.REFRESH_TOKEN)
+	deviceCode, userCode := f.authorize(t)
+
+	if code, out := f.pollNow(t, deviceCode); code != http.StatusBadRequest || out["error"] != "authorization_pending" {
+		t.Errorf("first poll = %d %v, want authorization_pending", code, out)
+	}
+	if code, out := f.pollNow(t, deviceCode); code != http.StatusBadRequest || out["error"] != "slow_down" {
+		t.Errorf("early poll = %d %v, want slow_down", code, out)
+	}
+
+	if code := f.verify(t, userCode, "approve", false); code != http.StatusForbidden {
+		t.Errorf("approval without anti-CSRF token = %d, want 403", code)
+	}
+	if code, out := f.poll(t, deviceCode); out["error"] != "authorization_pending" {
+		t.Errorf("poll after forged approval = %d %v, want authorization_pending", code, out)
+	}
+	if code := f.verify(t, userCode, "approve", true); code != http.StatusOK {
+		t.Fatalf("approval = %d", code)
+	}
+
+	code, out := f.poll(t, deviceCode)
+	if code != http.StatusOK || out["access_token"] == nil || out["refresh_token"] == nil || out["scope"] != "read" {
+		t.Fatalf("exchange = %d %v, want access and refresh token", code, out)
+	}
+	access, err := f.s.LoadAccess(out["access_token"].(string))
+	if err != nil || access.UserData != "user" {
+		t.Errorf("LoadAccess = %v, %v, want the approved UserData", access, err)
+	}
+	if code, out := f.poll(t, deviceCode); code != http.StatusBadRequest || out["error"] != osin.E_INVALID_GRANT {
+		t.Errorf("second exchange = %d %v, want invalid_grant", code, out)
+	}
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	f := newDeviceFlow(t, osin.AUTHORIZATION_CODE)
+	deviceCode, userCode := f.authorize(t)
+	if code := f.verify(t, userCode, "deny", true); code != http.StatusOK {
+		t.Fatalf("denial = %d", code)
+	}
+	if code, out := f.poll(t, deviceCode); code != http.StatusBadRequest || out["error"] != osin.E_ACCESS_DENIED {
+		t.Errorf("poll after denial = %d %v, want access_denied", code, out)
+	}
+}
+
+func TestDeviceFlowExpired(t *testing.T) {
+	f := newDeviceFlow(t, osin.AUTHORIZATION_CODE)
+	d, err := storage.NewDeviceCode(f.client.Id, "read", 60, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.CreatedAt = time.Now().Add(-time.Hour)
+	if err := f.s.SaveDeviceCode(d); err != nil {
+		t.Fatal(err)
+	}
+	if code, out := f.poll(t, d.DeviceCode); code != http.StatusBadRequest || out["error"] != "expired_token" {
+		t.Errorf("poll of expired code = %d %v, want expired_token", code, out)
+	}
+}
+
+func TestDeviceFlowWithoutRefresh(t *testing.T) {
+	f := newDeviceFlow(t, osin.AUTHORIZATION_CODE)
+	deviceCode, userCode := f.authorize(t)
+	if code := f.verify(t, userCode, "approve", true); code != http.StatusOK {
+		t.Fatalf("approval = %d", code)
+	}
+	code, out := f.poll(t, deviceCode)
+	if code != http.StatusOK || out["access_token"] == nil {
+		t.Fatalf("exchange = %d %v", code, out)
+	}
+	if _, ok := out["refresh_token"]; ok {
+		t.Errorf("exchange = %v, want no refresh_token", out)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/openshift/osin"
+)
+
+// Endpoints are the URLs advertised by MetadataHandler. Empty endpoints are omitted.
+type Endpoints struct {
+	Issuer        string
+	Authorization string
+	Token         string
+	UserInfo      string
+	JWKS          string
+	Introspection string
+	Revocation    string
+	Registration  string
+	Device        string // rfc8628 device authorization endpoint
+	Pushed        string // rfc9126 pushed authorization request endpoint
+}
+
+// Metadata is the authorization server metadata document described in rfc8414,
+// extended with the OpenID Connect discovery fields.
+type Metadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	PushedAuthorizationEndpoint       string   `json:"pushed_authorization_request_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+
+	// OpenID Connect discovery only
+	SubjectTypesSupported            []string `json:"subject_types_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	ClaimsParameterSupported         bool     `json:"claims_parameter_supported,omitempty"`
+}
+
+// NewMetadata builds the metadata of a server configured with config.
+// The signing algorithms are those of the keys published by keys, which may be nil.
+func NewMetadata(config *osin.ServerConfig, endpoints Endpoints, keys *KeyStore) (*Metadata, error) {
+	m := &Metadata{
+		Issuer:                            endpoints.Issuer,
+		AuthorizationEndpoint:             endpoints.Authorization,
+		TokenEndpoint:                     endpoints.Token,
+		UserInfoEndpoint:                  endpoints.UserInfo,
+		JWKSURI:                           endpoints.JWKS,
+		IntrospectionEndpoint:             endpoints.Introspection,
+		RevocationEndpoint:                endpoints.Revocation,
+		RegistrationEndpoint:              endpoints.Registration,
+		DeviceAuthorizationEndpoint:       endpoints.Device,
+		PushedAuthorizationEndpoint:       endpoints.Pushed,
+		ResponseTypesSupported:            []string{},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		CodeChallengeMethodsSupported:     []string{"plain", "S256"},
+	}
+	for _, t := range config.AllowedAuthorizeTypes {
+		m.ResponseTypesSupported = append(m.ResponseTypesSupported, string(t))
+		if t == osin.TOKEN {
+			m.GrantTypesSupported = append(m.GrantTypesSupported, "implicit")
+		}
+	}
+	for _, t := range config.AllowedAccessTypes {
+		if t == osin.IMPLICIT {
+			continue
+		}
+		m.GrantTypesSupported = append(m.GrantTypesSupported, string(t))
+	}
+	if endpoints.Device != "" {
+		m.GrantTypesSupported = append(m.GrantTypesSupported, DeviceCodeGrantType)
+	}
+	if config.AllowClientSecretInParams {
+		m.TokenEndpointAuthMethodsSupported = append(m.TokenEndpointAuthMethodsSupported, "client_secret_post")
+	}
+
+	if keys != nil {
+		published, err := keys.Published()
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, k := range published {
+			if !seen[k.Algorithm] {
+				seen[k.Algorithm] = true
+				m.IDTokenSigningAlgValuesSupported = append(m.IDTokenSigningAlgValuesSupported, k.Algorithm)
+			}
+		}
+	}
+	return m, nil
+}
+
+// openID returns m with the fields required by OpenID Connect discovery
+func (m Metadata) openID() Metadata {
+	m.SubjectTypesSupported = []string{"public"}
+	m.ClaimsParameterSupported = true
+	if len(m.IDTokenSigningAlgValuesSupported) == 0 {
+		m.IDTokenSigningAlgValuesSupported = []string{RS256}
+	}
+	return m
+}
+
+// MetadataHandler serves the rfc8414 /.well-known/oauth-authorization-server document and,
+// for requests whose path ends with /.well-known/openid-configuration, the OpenID Connect
+// discovery document. Register it on both paths.
+func MetadataHandler(config *osin.ServerConfig, endpoints Endpoints, keys *KeyStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, err := NewMetadata(config, endpoints, keys)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration") {
+			*m = m.openID()
+		} else {
+			m.IDTokenSigningAlgValuesSupported = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(m)
+	})
+}
@@ -0,0 +1,72 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+)
+
+func TestMetadataHandler(t *testing.T) {
+	_, keys, _, _ := newJWTStorage(t)
+	key, err := keys.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := osin.NewServerConfig()
+	config.AllowedAuthorizeTypes = osin.AllowedAuthorizeType{osin.CODE, osin.TOKEN}
+	config.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE, osin.REFRESH_TOKEN}
+	config.AllowClientSecretInParams = true
+	endpoints := storage.Endpoints{
+		Issuer:        "https://auth.example.com",
+		Authorization: "https://auth.example.com/authorize",
+		Token:         "https://auth.example.com/token",
+		UserInfo:      "https://auth.example.com/userinfo",
+		JWKS:          "https://auth.example.com/.well-known/jwks.json",
+		Device:        "https://auth.example.com/device",
+	}
+	handler := storage.MetadataHandler(config, endpoints, keys)
+
+	for _, tc := range []struct {
+		path   string
+		openID bool
+	}{
+		{"/.well-known/oauth-authorization-server", false},
+		{"/.well-known/openid-configuration", true},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: status = %d, Content-Type = %q", tc.path, w.Code, w.Header().Get("Content-Type"))
+		}
+		var m map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]interface{}{
+			"issuer":                                endpoints.Issuer,
+			"authorization_endpoint":                endpoints.Authorization,
+			"token_endpoint":                        endpoints.Token,
+			"userinfo_endpoint":                     endpoints.UserInfo,
+			"jwks_uri":                              endpoints.JWKS,
+			"device_authorization_endpoint":         endpoints.Device,
+			"response_types_supported":              []interface{}{"code", "token"},
+			"grant_types_supported":                 []interface{}{"implicit", "authorization_code", "refresh_token", storage.DeviceCodeGrantType},
+			"token_endpoint_auth_methods_supported": []interface{}{"client_secret_basic", "client_secret_post"},
+			"code_challenge_methods_supported":      []interface{}{"plain", "S256"},
+		}
+		if tc.openID {
+			want["subject_types_supported"] = []interface{}{"public"}
+			want["id_token_signing_alg_values_supported"] = []interface{}{key.Algorithm}
+			want["claims_parameter_supported"] = true
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("%s:\n got %v\nwant %v", tc.path, m, want)
+		}
+	}
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gislik/gorm"
 	_ "github.com/gislik/gorm/dialects/postgres"
 	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/otelstorage"
+	"github.com/gislik/osin-storage/promstorage"
 	"github.com/openshift/osin"
 	"github.com/openshift/osin/example"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //InitDB initial gorm db
@@ -21,12 +33,90 @@ func InitDB() (*gorm.DB, error) {
 
 	db.AutoMigrate(
 		&storage.Access{},
+		&storage.AccessScope{},
 		&storage.Authorize{},
 		&storage.Client{},
+		&storage.SigningKey{},
+		&storage.DeviceCode{},
+		&storage.PushedRequest{},
+		&storage.Consent{},
+		&storage.Scope{},
+		&storage.ClientScope{},
+		&storage.AuditEvent{},
+		&storage.OutboxEvent{},
 	)
 	return db, nil
 }
 
+// sessionKey signs the session cookie of logged in users, sessions end when the server restarts
+var sessionKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+const sessionCookie = "session"
+
+// sessionMAC authenticates the session of subject
+func sessionMAC(subject string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetSession remembers that subject logged in, so the consent page does not ask for the password again
+func SetSession(w http.ResponseWriter, subject string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + sessionMAC(subject),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Session returns the subject logged in with r
+func Session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	i := strings.IndexByte(c.Value, '.')
+	if i < 0 {
+		return "", false
+	}
+	subject, err := base64.RawURLEncoding.DecodeString(c.Value[:i])
+	if err != nil || !hmac.Equal([]byte(c.Value[i+1:]), []byte(sessionMAC(string(subject)))) {
+		return "", false
+	}
+	return string(subject), true
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<html><body>
+<p>{{.Client}} requests access to: {{.Scope}}</p>
+<form action="{{.Action}}" method="POST">
+<button type="submit" name="consent" value="allow">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</form>
+</body></html>`))
+
+// HandleConsentPage asks the logged in user to grant the requested scope.
+// The answer is posted back to the authorization request, the user is known from the session.
+func HandleConsentPage(ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request) {
+	action := url.URL{Path: r.URL.Path, RawQuery: r.URL.Query().Encode()}
+	consentTemplate.Execute(w, map[string]string{
+		"Client": ar.Client.GetId(),
+		"Scope":  ar.Scope,
+		"Action": action.String(),
+	})
+}
+
+var consentsTemplate = template.Must(template.New("consents").Parse(`<html><body>
+{{range .}}<p>{{.ClientID}}: {{.Scope}} <a href="/consents?revoke={{.ClientID}}">Revoke</a></p>
+{{end}}</body></html>`))
+
 func main() {
 
 	db, err := InitDB()
@@ -43,7 +133,79 @@ func main() {
 	sconfig.AllowedAccessTypes = osin.AllowedAccessType{osin.REFRESH_TOKEN, osin.PASSWORD, osin.CLIENT_CREDENTIALS, osin.AUTHORIZATION_CODE}
 	sconfig.AllowGetAccessRequest = true
 	sconfig.AllowClientSecretInParams = true
-	server := osin.NewServer(sconfig, storage.NewStorage(db))
+
+	keys, err := storage.NewKeyStore(db, nil)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = keys.RotateIfDue(); err != nil {
+		panic(err)
+	}
+	keys.StartRotation(time.Hour, nil)
+	defer keys.StopRotation()
+
+	store := storage.NewStorage(db, storage.ValidateTokens(), storage.WithKeyStore(keys), storage.WithAudit(), storage.WithOutbox(),
+		storage.WithHooks(storage.Hooks{
+			OnAccessSaved: func(ctx context.Context, data *osin.AccessData) {
+				fmt.Printf("access token issued to %s\n", data.Client.GetId())
+			},
+		}),
+	)
+	// tokens saved before oauth_access_scope was migrated are indexed once
+	if _, err := store.IndexAccessScopes(); err != nil {
+		panic(err)
+	}
+	// trace storage calls and their queries with the global tracer provider
+	otelstorage.RegisterCallbacks(db, nil)
+	traced := otelstorage.New(store, nil)
+	metered := promstorage.New(traced)
+	prometheus.MustRegister(metered)
+	server := osin.NewServer(sconfig, metered)
+	server.AuthorizeTokenGen = storage.TokenGen{}
+	server.AccessTokenGen = storage.TokenGen{}
+	// purge expired data every minute
+	go func() {
+		for range time.Tick(time.Minute) {
+			if _, err := metered.PurgeExpired(); err != nil {
+				fmt.Printf("ERROR: %s\n", err)
+			}
+		}
+	}()
+	relay := storage.NewRelay(db, storage.NewStdoutPublisher())
+	relay.Start(time.Second, func(err error) { fmt.Printf("ERROR: %s\n", err) })
+	defer relay.Stop()
+	// claims releases the claims of the test user for the profile scope and the claims request
+	claims := func(subject, scope string, requested []string) (map[string]interface{}, error) {
+		user := map[string]interface{}{"name": subject, "preferred_username": subject}
+		released := make(map[string]interface{})
+		for _, name := range requested {
+			if v, ok := user[name]; ok {
+				released[name] = v
+			}
+		}
+		for _, s := range strings.Fields(scope) {
+			if s != "profile" {
+				continue
+			}
+			for name, v := range user {
+				released[name] = v
+			}
+		}
+		return released, nil
+	}
+	idTokens := &storage.IDTokenGen{Keys: keys, Issuer: "http://localhost:14000", Claims: claims}
+	consents := storage.NewConsentStore(db)
+	scopes := storage.NewScopeRegistry(db)
+	// withRequest returns a copy of the server whose storage records the IP and user agent of r in the audit log
+	// and traces its calls as children of the span of r. The device and pushed request methods are not
+	// forwarded by the otelstorage and promstorage wrappers, they are called on the returned storage,
+	// whose queries are still traced.
+	withRequest := func(r *http.Request) (*osin.Server, *storage.Storage) {
+		ctx := storage.RequestContext(r)
+		srv := *server
+		srv.Storage = metered.With(traced.WithContext(ctx))
+		return &srv, store.WithContext(ctx)
+	}
 
 	//create a test client
 	client := storage.Client{
@@ -57,20 +219,77 @@ func main() {
 		}
 	}
 
+	//register the scopes of the test client
+	for _, scope := range []storage.Scope{
+		{Name: "everything", Description: "Access everything", Default: true},
+		{Name: "openid", Description: "Sign you in"},
+	} {
+		if err := scopes.SaveScope(&scope); err != nil {
+			panic(err)
+		}
+	}
+	if err := scopes.Allow(client.ID, "everything", "openid"); err != nil {
+		panic(err)
+	}
+
 	//Copy from https://github.com/RangelReale/osin/tree/master/example/complete
 	//Changed 1234 to testclient
 	// Authorization code endpoint
 	http.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		server, store := withRequest(r)
 		resp := server.NewResponse()
 		defer resp.Close()
 
-		if ar := server.HandleAuthorizeRequest(resp, r); ar != nil {
-			if !example.HandleLoginPage(ar, w, r) {
+		if _, err := storage.ResolvePushedRequest(store, r); err != nil {
+			resp.SetError(osin.E_INVALID_REQUEST, "")
+			resp.InternalError = err
+		} else if ar := server.HandleAuthorizeRequest(resp, r); ar != nil {
+			var err error
+			if ar.Scope, err = scopes.Validate(ar.Client.GetId(), ar.Scope); err == storage.ErrInvalidScope {
+				resp.SetError(osin.E_INVALID_SCOPE, "")
+				osin.OutputJSON(resp, w, r)
 				return
 			}
-			ar.UserData = struct{ Login string }{Login: "test"}
-			ar.Authorized = true
-			server.FinishAuthorizeRequest(resp, r, ar)
+			subject, ok := Session(r)
+			if !ok {
+				if !example.HandleLoginPage(ar, w, r) {
+					return
+				}
+				subject = "test"
+				SetSession(w, subject)
+			}
+			// returning users skip the consent page when they already granted the requested scope
+			covered := false
+			if err == nil {
+				covered, err = consents.Covers(subject, ar.Client.GetId(), ar.Scope)
+			}
+			if err == nil && !covered {
+				switch r.FormValue("consent") {
+				case "":
+					HandleConsentPage(ar, w, r)
+					return
+				case "allow":
+					err = consents.Grant(subject, ar.Client.GetId(), ar.Scope)
+					covered = true
+				}
+			}
+			// the pushed request is used once, when the authorization is decided
+			if err == nil {
+				err = storage.ConsumeResolvedRequest(store, r)
+			}
+			if err == storage.ErrNotFound || err == storage.ErrExpiredRequest {
+				resp.SetError(osin.E_INVALID_REQUEST, "")
+			} else if err != nil {
+				resp.SetError(osin.E_SERVER_ERROR, "")
+				resp.InternalError = err
+			} else {
+				ar.UserData = &storage.OpenIDUserData{
+					OpenIDRequest: storage.NewOpenIDRequest(r, subject),
+					UserData:      struct{ Login string }{Login: subject},
+				}
+				ar.Authorized = covered
+				server.FinishAuthorizeRequest(resp, r, ar)
+			}
 		}
 		if resp.IsError && resp.InternalError != nil {
 			fmt.Printf("ERROR: %s\n", resp.InternalError)
@@ -83,10 +302,22 @@ func main() {
 
 	// Access token endpoint
 	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		server, store := withRequest(r)
+		if storage.HandleDeviceAccessRequest(server, store, w, r) {
+			return
+		}
+
 		resp := server.NewResponse()
 		defer resp.Close()
 
 		if ar := server.HandleAccessRequest(resp, r); ar != nil {
+			var err error
+			if ar.Scope, err = scopes.Validate(ar.Client.GetId(), ar.Scope); err != nil {
+				resp.SetError(osin.E_INVALID_SCOPE, "")
+				resp.InternalError = err
+				osin.OutputJSON(resp, w, r)
+				return
+			}
 			switch ar.Type {
 			case osin.AUTHORIZATION_CODE:
 				ar.Authorized = true
@@ -104,6 +335,10 @@ func main() {
 				}
 			}
 			server.FinishAccessRequest(resp, r, ar)
+			if err := idTokens.FinishIDToken(resp, server.Storage); err != nil {
+				resp.SetError(osin.E_SERVER_ERROR, "")
+				resp.InternalError = err
+			}
 		}
 		if resp.IsError && resp.InternalError != nil {
 			fmt.Printf("ERROR: %s\n", resp.InternalError)
@@ -114,6 +349,53 @@ func main() {
 		osin.OutputJSON(resp, w, r)
 	})
 
+	// Pushed authorization request endpoint
+	http.Handle("/par", storage.PushedAuthorizationHandler(store, 0))
+
+	// Device authorization endpoints
+	http.Handle("/device_authorization", storage.DeviceAuthorizationHandler(store, storage.DeviceConfig{
+		VerificationURI: "http://localhost:14000/device",
+	}))
+	http.Handle("/device", storage.DeviceVerificationHandler(store, func(w http.ResponseWriter, r *http.Request, d *storage.DeviceCode) (interface{}, bool) {
+		if r.FormValue("login") != "test" || r.FormValue("password") != "test" {
+			w.Write([]byte("<html><body>"))
+			w.Write([]byte(fmt.Sprintf("LOGIN %s (use test/test)<br/>", d.ClientID)))
+			w.Write([]byte("<form method=\"POST\">"))
+			w.Write([]byte(fmt.Sprintf("<input type=\"hidden\" name=\"user_code\" value=\"%s\" />", d.FormattedUserCode())))
+			w.Write([]byte(fmt.Sprintf("<input type=\"hidden\" name=\"action\" value=\"%s\" />", r.FormValue("action"))))
+			w.Write([]byte(fmt.Sprintf("<input type=\"hidden\" name=\"%s\" value=\"%s\" />", storage.DeviceCSRFField, storage.DeviceCSRFToken(r))))
+			w.Write([]byte("Login: <input type=\"text\" name=\"login\" /><br/>"))
+			w.Write([]byte("Password: <input type=\"password\" name=\"password\" /><br/>"))
+			w.Write([]byte("<input type=\"submit\"/>"))
+			w.Write([]byte("</form>"))
+			w.Write([]byte("</body></html>"))
+			return nil, false
+		}
+		return struct{ Login string }{Login: "test"}, true
+	}))
+
+	// OpenID Connect userinfo endpoint
+	http.Handle("/userinfo", storage.UserInfoHandler(server.Storage, claims))
+
+	// Discovery endpoints
+	metadata := storage.MetadataHandler(sconfig, storage.Endpoints{
+		Issuer:        "http://localhost:14000",
+		Authorization: "http://localhost:14000/authorize",
+		Token:         "http://localhost:14000/token",
+		UserInfo:      "http://localhost:14000/userinfo",
+		JWKS:          "http://localhost:14000/.well-known/jwks.json",
+		Device:        "http://localhost:14000/device_authorization",
+		Pushed:        "http://localhost:14000/par",
+	}, keys)
+	http.Handle("/.well-known/oauth-authorization-server", metadata)
+	http.Handle("/.well-known/openid-configuration", metadata)
+
+	// Signing keys endpoint
+	http.Handle("/.well-known/jwks.json", storage.JWKSHandler(keys))
+
+	// Metrics endpoint
+	http.Handle("/metrics", promhttp.Handler())
+
 	// Information endpoint
 	http.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
 		resp := server.NewResponse()
@@ -446,6 +728,21 @@ func main() {
 		}
 	})
 
+	// Consents of the test user
+	http.HandleFunc("/consents", func(w http.ResponseWriter, r *http.Request) {
+		if client := r.FormValue("revoke"); client != "" {
+			if err := consents.Revoke("test", client, ""); err != nil {
+				fmt.Printf("ERROR: %s\n", err)
+			}
+		}
+		list, err := consents.List("test")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		consentsTemplate.Execute(w, list)
+	})
+
 	http.ListenAndServe(":14000", nil)
 
 }
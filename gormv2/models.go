@@ -0,0 +1,172 @@
+package gormv2
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// Client model, stored in the same oauth_client table as storage.Client
+type Client struct {
+	ID          string `gorm:"primaryKey"`
+	Secret      string
+	RedirectUri string
+	UserData    string
+}
+
+// TableName is used by `gorm`
+func (Client) TableName() string {
+	return "oauth_client"
+}
+
+// Authorize data model, stored in the same oauth_authorize table as storage.Authorize
+type Authorize struct {
+	ClientID            string    // Client information
+	Code                string    `gorm:"primaryKey"` // Authorization code
+	ExpiresIn           int32     // Token expiration in seconds
+	Scope               string    // Requested scope
+	RedirectUri         string    // Redirect Uri from request
+	State               string    // State data from request
+	CreatedAt           time.Time // Date created
+	UserData            string    // Data to be passed to storage. Not used by the library.
+	CodeChallenge       string    // Optional code_challenge as described in rfc7636
+	CodeChallengeMethod string    // Optional code_challenge_method as described in rfc7636
+	model.OpenIDRequest           // OpenID Connect request parameters
+}
+
+// TableName is used by `gorm`
+func (Authorize) TableName() string {
+	return "oauth_authorize"
+}
+
+// Access data model, stored in the same oauth_access table as storage.Access
+type Access struct {
+	ClientID            string    // Client information
+	Authorize           string    // Authorize data, for authorization code
+	PrvAccess           string    // Previous access data, for refresh token
+	AccessToken         string    `gorm:"primaryKey"` // Access token
+	RefreshToken        string    // Refresh Token. Can be blank
+	ExpiresIn           int32     // Token expiration in seconds
+	Scope               string    // Requested scope
+	RedirectUri         string    // Redirect Uri from request
+	CreatedAt           time.Time // Date created
+	UserData            string    // Data to be passed to storage. Not used by the library.
+	model.OpenIDRequest           // OpenID Connect request parameters
+}
+
+// TableName is used by `gorm`
+func (Access) TableName() string {
+	return "oauth_access"
+}
+
+// AccessScope model, stored in the same oauth_access_scope table as storage.AccessScope
+type AccessScope struct {
+	AccessToken string `gorm:"primaryKey"`       // Access token
+	Scope       string `gorm:"primaryKey;index"` // Scope name
+}
+
+// TableName is used by `gorm`
+func (AccessScope) TableName() string {
+	return "oauth_access_scope"
+}
+
+func clientFromOsin(c osin.Client) (Client, error) {
+	v, err := model.UserDataToString(c.GetUserData())
+	return Client{
+		ID:          c.GetId(),
+		Secret:      c.GetSecret(),
+		RedirectUri: c.GetRedirectUri(),
+		UserData:    v,
+	}, err
+}
+
+func (c *Client) toOsin() osin.Client {
+	return &osin.DefaultClient{
+		Id:          c.ID,
+		Secret:      c.Secret,
+		RedirectUri: c.RedirectUri,
+		UserData:    c.UserData,
+	}
+}
+
+func authorizeFromOsin(data *osin.AuthorizeData) (Authorize, error) {
+	oid, userData := model.SplitUserData(data.UserData)
+	v, err := model.UserDataToString(userData)
+	return Authorize{
+		ClientID:            data.Client.GetId(),
+		Code:                data.Code,
+		ExpiresIn:           data.ExpiresIn,
+		Scope:               data.Scope,
+		RedirectUri:         data.RedirectUri,
+		State:               data.State,
+		CreatedAt:           data.CreatedAt,
+		UserData:            v,
+		CodeChallenge:       data.CodeChallenge,
+		CodeChallengeMethod: data.CodeChallengeMethod,
+		OpenIDRequest:       oid,
+	}, err
+}
+
+func (a *Authorize) toOsin(client osin.Client) *osin.AuthorizeData {
+	oa := &osin.AuthorizeData{
+		Client:              client,
+		Code:                a.Code,
+		ExpiresIn:           a.ExpiresIn,
+		Scope:               a.Scope,
+		RedirectUri:         a.RedirectUri,
+		State:               a.State,
+		CreatedAt:           a.CreatedAt,
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
+	}
+	oa.UserData = model.JoinUserData(a.OpenIDRequest, a.UserData)
+	return oa
+}
+
+func accessFromOsin(data *osin.AccessData) (Access, error) {
+	oid, userData := model.SplitUserData(data.UserData)
+	v, err := model.UserDataToString(userData)
+	access := Access{
+		ClientID:      data.Client.GetId(),
+		AccessToken:   data.AccessToken,
+		RefreshToken:  data.RefreshToken,
+		ExpiresIn:     data.ExpiresIn,
+		Scope:         data.Scope,
+		RedirectUri:   data.RedirectUri,
+		CreatedAt:     data.CreatedAt,
+		UserData:      v,
+		OpenIDRequest: oid,
+	}
+	if data.AccessData != nil {
+		access.PrvAccess = data.AccessData.AccessToken
+	}
+	if data.AuthorizeData != nil {
+		access.Authorize = data.AuthorizeData.Code
+	}
+	return access, err
+}
+
+func (a *Access) toOsin(client osin.Client) *osin.AccessData {
+	oa := &osin.AccessData{
+		Client:       client,
+		AccessToken:  a.AccessToken,
+		RefreshToken: a.RefreshToken,
+		ExpiresIn:    a.ExpiresIn,
+		Scope:        a.Scope,
+		RedirectUri:  a.RedirectUri,
+		CreatedAt:    a.CreatedAt,
+	}
+	oa.UserData = model.JoinUserData(a.OpenIDRequest, a.UserData)
+	return oa
+}
+
+// accessScopes returns the oauth_access_scope rows indexing the scopes of a
+func (a *Access) accessScopes() []AccessScope {
+	var scopes []AccessScope
+	for _, scope := range strings.Fields(model.NormalizeScope(a.Scope)) {
+		scopes = append(scopes, AccessScope{AccessToken: a.AccessToken, Scope: scope})
+	}
+	return scopes
+}
@@ -0,0 +1,191 @@
+// Package gormv2 implements osin.Storage on gorm v2 (gorm.io/gorm).
+//
+// It reads and writes the oauth_client, oauth_authorize, oauth_access and oauth_access_scope tables
+// created by storage.Storage, so existing data keeps working after switching.
+// Existing tables should be kept rather than migrated again with gorm v2,
+// which picks different column types than v1 on some dialects.
+package gormv2
+
+import (
+	"context"
+
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNotFound is storage.ErrNotFound, returned by the Remove methods when nothing matched
+var ErrNotFound = model.ErrNotFound
+
+type Storage struct {
+	db *gorm.DB
+}
+
+func NewStorage(db *gorm.DB) *Storage {
+	return &Storage{db}
+}
+
+// WithContext returns a Storage running its queries with ctx
+func (s *Storage) WithContext(ctx context.Context) *Storage {
+	return &Storage{s.db.WithContext(ctx)}
+}
+
+// StorageWithContext is WithContext returning an osin.Storage, for wrappers like otelstorage
+func (s *Storage) StorageWithContext(ctx context.Context) osin.Storage {
+	return s.WithContext(ctx)
+}
+
+// Clone the storage if needed.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds
+func (s *Storage) Close() {
+}
+
+// GetClient loads the client by id (client_id)
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var c Client
+	if err := s.db.Where("id = ?", id).First(&c).Error; err != nil {
+		return nil, err
+	}
+	return c.toOsin(), nil
+}
+
+// SaveClient saves client
+func (s *Storage) SaveClient(c osin.Client) error {
+	client, err := clientFromOsin(c)
+	if err != nil {
+		return err
+	}
+	return s.db.Create(&client).Error
+}
+
+// UpdateClient saves client, replacing the client with the same id
+func (s *Storage) UpdateClient(c osin.Client) error {
+	client, err := clientFromOsin(c)
+	if err != nil {
+		return err
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		UpdateAll: true,
+	}).Create(&client).Error
+}
+
+// RemoveClient removes the client with matching id
+func (s *Storage) RemoveClient(id string) error {
+	return remove(s.db.Where("id = ?", id).Delete(&Client{}))
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	authorize, err := authorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Create(&authorize).Error
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var authorize Authorize
+	if err := s.db.Where("code = ?", code).First(&authorize).Error; err != nil {
+		return nil, err
+	}
+	client, err := s.GetClient(authorize.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return authorize.toOsin(client), nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	return remove(s.db.Where("code = ?", code).Delete(&Authorize{}))
+}
+
+// SaveAccess writes AccessData and indexes its scopes in a transaction.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	access, err := accessFromOsin(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&access).Error; err != nil {
+			return err
+		}
+		if scopes := access.accessScopes(); len(scopes) > 0 {
+			return tx.Create(&scopes).Error
+		}
+		return nil
+	})
+}
+
+// LoadAccess retrieves access data by token.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	return s.loadAccess("access_token = ?", code)
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *Storage) RemoveAccess(code string) error {
+	return s.removeAccess("access_token = ?", code)
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	return s.loadAccess("refresh_token = ?", code)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *Storage) RemoveRefresh(code string) error {
+	return s.removeAccess("refresh_token = ?", code)
+}
+
+// loadAccess loads the access data matching query together with its client and authorize data.
+// Missing authorize data is not an error.
+func (s *Storage) loadAccess(query string, code string) (*osin.AccessData, error) {
+	var a Access
+	if err := s.db.Where(query, code).First(&a).Error; err != nil {
+		return nil, err
+	}
+	client, err := s.GetClient(a.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	oa := a.toOsin(client)
+	if a.Authorize != "" {
+		var authorize Authorize
+		if err := s.db.Where("code = ? AND client_id = ?", a.Authorize, a.ClientID).Take(&authorize).Error; err == nil {
+			oa.AuthorizeData = authorize.toOsin(client)
+		}
+	}
+	return oa, nil
+}
+
+// removeAccess deletes the access data matching query together with its scopes
+func (s *Storage) removeAccess(query string, code string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var tokens []string
+		if err := tx.Model(&Access{}).Where(query, code).Pluck("access_token", &tokens).Error; err != nil {
+			return err
+		}
+		if err := remove(tx.Where(query, code).Delete(&Access{})); err != nil {
+			return err
+		}
+		return tx.Where("access_token IN ?", tokens).Delete(&AccessScope{}).Error
+	})
+}
+
+// remove reports the outcome of a delete statement
+func remove(db *gorm.DB) error {
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package gormv2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newStorage returns a Storage on an in-memory SQLite database
+func newStorage(t *testing.T) *Storage {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&Client{}, &Authorize{}, &Access{}, &AccessScope{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewStorage(db)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		return newStorage(t)
+	})
+}
+
+func TestOpenIDAndScopes(t *testing.T) {
+	s := newStorage(t)
+	client := &osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	data := &osin.AccessData{
+		Client:      client,
+		AccessToken: "access",
+		ExpiresIn:   3600,
+		Scope:       "openid profile openid",
+		CreatedAt:   time.Now(),
+		UserData:    &model.OpenIDUserData{OpenIDRequest: model.OpenIDRequest{Subject: "user", Nonce: "nonce"}},
+	}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.LoadAccess(data.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ud, ok := got.UserData.(*model.OpenIDUserData); !ok || ud.Subject != "user" || ud.Nonce != "nonce" {
+		t.Errorf("UserData = %#v, want the OpenID request", got.UserData)
+	}
+	var scopes []string
+	s.db.Model(&AccessScope{}).Where("access_token = ?", data.AccessToken).Order("scope").Pluck("scope", &scopes)
+	if len(scopes) != 2 || scopes[0] != "openid" || scopes[1] != "profile" {
+		t.Errorf("indexed scopes = %v, want [openid profile]", scopes)
+	}
+
+	if err := s.RemoveAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	s.db.Model(&AccessScope{}).Where("access_token = ?", data.AccessToken).Count(&n)
+	if n != 0 {
+		t.Errorf("%d scopes left after RemoveAccess", n)
+	}
+	if err := s.RemoveAccess(data.AccessToken); err != ErrNotFound {
+		t.Errorf("RemoveAccess of missing token = %v, want ErrNotFound", err)
+	}
+}
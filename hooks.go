@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/openshift/osin"
+)
+
+// Hooks are called by Storage around its mutations, nil hooks are skipped.
+//
+// Before hooks run synchronously before the mutation, returning an error vetoes it
+// and the error is returned by the Storage method. On hooks run once the mutation
+// was committed, through the Dispatcher of the storage. The context is the one
+// passed to WithContext, context.Background() otherwise.
+type Hooks struct {
+	BeforeClientSaved      func(ctx context.Context, client osin.Client) error
+	OnClientSaved          func(ctx context.Context, client osin.Client)
+	BeforeClientRemoved    func(ctx context.Context, id string) error
+	OnClientRemoved        func(ctx context.Context, id string)
+	BeforeAuthorizeSaved   func(ctx context.Context, data *osin.AuthorizeData) error
+	OnAuthorizeSaved       func(ctx context.Context, data *osin.AuthorizeData)
+	BeforeAuthorizeRemoved func(ctx context.Context, code string) error
+	OnAuthorizeRemoved     func(ctx context.Context, code string)
+	BeforeAccessSaved      func(ctx context.Context, data *osin.AccessData) error
+	OnAccessSaved          func(ctx context.Context, data *osin.AccessData)
+	BeforeAccessRemoved    func(ctx context.Context, token string) error // Also called for each token RevokeByScope removes
+	OnAccessRemoved        func(ctx context.Context, token string)       // Also called for each token removed by RevokeByScope
+	BeforeRefreshRemoved   func(ctx context.Context, token string) error
+	OnRefreshRemoved       func(ctx context.Context, token string)
+}
+
+// WithHooks registers hooks, hooks registered first are called first
+func WithHooks(hooks Hooks) Option {
+	return func(s *Storage) {
+		s.hooks = append(s.hooks, hooks)
+	}
+}
+
+// WithDispatcher sets the Dispatcher calling the On hooks, SyncDispatcher by default
+func WithDispatcher(d Dispatcher) Option {
+	return func(s *Storage) {
+		s.dispatcher = d
+	}
+}
+
+// Dispatcher calls the On hooks
+type Dispatcher interface {
+	Dispatch(fn func())
+}
+
+// SyncDispatcher calls hooks in the goroutine of the Storage method, which returns once they did
+type SyncDispatcher struct{}
+
+// Dispatch calls fn
+func (SyncDispatcher) Dispatch(fn func()) {
+	fn()
+}
+
+// AsyncDispatcher calls hooks from a pool of goroutines so slow hooks don't delay storage calls.
+// Dispatch blocks while the queue is full. The On hooks saving data get a shallow copy of it,
+// the caller may change its data once the storage call returned.
+type AsyncDispatcher struct {
+	queue   chan func()
+	done    chan struct{}  // closed by Close, unblocks the Dispatch calls waiting on a full queue
+	wg      sync.WaitGroup // workers
+	pending sync.WaitGroup // Dispatch calls sending to the queue
+	mu      sync.RWMutex
+	closed  bool
+}
+
+// NewAsyncDispatcher starts workers goroutines calling hooks queued in a queue of size queue
+func NewAsyncDispatcher(workers, queue int) *AsyncDispatcher {
+	d := &AsyncDispatcher{queue: make(chan func(), queue), done: make(chan struct{})}
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer d.wg.Done()
+			for fn := range d.queue {
+				fn()
+			}
+		}()
+	}
+	return d
+}
+
+// Dispatch queues fn, it calls fn itself once the dispatcher was closed.
+// The lock is not held while waiting on a full queue, so hooks may dispatch while Close runs.
+func (d *AsyncDispatcher) Dispatch(fn func()) {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		fn()
+		return
+	}
+	d.pending.Add(1)
+	d.mu.RUnlock()
+	defer d.pending.Done()
+
+	select {
+	case d.queue <- fn:
+	case <-d.done:
+		fn()
+	}
+}
+
+// Close waits for the queued hooks to be called and stops the workers.
+// Hooks dispatched afterwards are called synchronously.
+func (d *AsyncDispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	// no Dispatch sends to the queue once the pending ones returned, it can be closed
+	close(d.done)
+	d.pending.Wait()
+	close(d.queue)
+	d.wg.Wait()
+}
+
+// context returns the context of the storage
+func (s *Storage) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// before calls fn with each registered Hooks until it returns an error
+func (s *Storage) before(fn func(h *Hooks) error) error {
+	for i := range s.hooks {
+		if err := fn(&s.hooks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// after dispatches fn with each registered Hooks
+func (s *Storage) after(fn func(h *Hooks)) {
+	if len(s.hooks) == 0 {
+		return
+	}
+	d := s.dispatcher
+	if d == nil {
+		d = SyncDispatcher{}
+	}
+	hooks := s.hooks
+	d.Dispatch(func() {
+		for i := range hooks {
+			fn(&hooks[i])
+		}
+	})
+}
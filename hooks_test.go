@@ -0,0 +1,195 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestAsyncDispatcherClose(t *testing.T) {
+	d := storage.NewAsyncDispatcher(2, 1)
+	var mu sync.Mutex
+	calls := 0
+	call := func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Dispatch(call)
+		}()
+	}
+	d.Close()
+	wg.Wait()
+	d.Dispatch(call)
+	d.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 51 {
+		t.Errorf("hooks called %d times, want 51", calls)
+	}
+}
+
+func TestAsyncHooksGetACopy(t *testing.T) {
+	d := storage.NewAsyncDispatcher(1, 1)
+	release := make(chan struct{})
+	saved := make(chan string, 1)
+	s := storage.NewStorage(storagetest.OpenDB(t), storage.WithDispatcher(d), storage.WithHooks(storage.Hooks{
+		OnAccessSaved: func(ctx context.Context, data *osin.AccessData) {
+			<-release
+			saved <- data.Scope
+		},
+	}))
+	client := &osin.DefaultClient{Id: "hooked", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	data := &osin.AccessData{Client: client, AccessToken: "hooked", ExpiresIn: 3600, Scope: "read", CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	data.Scope = "changed"
+	close(release)
+	d.Close()
+	if scope := <-saved; scope != "read" {
+		t.Errorf("OnAccessSaved saw scope %q, want read", scope)
+	}
+}
+
+func TestAsyncDispatcherDispatchDuringClose(t *testing.T) {
+	d := storage.NewAsyncDispatcher(1, 1)
+	var mu sync.Mutex
+	calls := 0
+	call := func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}
+
+	// the worker is busy, the queue full and a third hook waits to be queued
+	release := make(chan struct{})
+	d.Dispatch(func() {
+		<-release
+		call()
+		// a hook dispatching while Close runs
+		d.Dispatch(call)
+	})
+	d.Dispatch(call)
+	waiting := make(chan struct{})
+	go func() {
+		close(waiting)
+		d.Dispatch(call)
+	}()
+	<-waiting
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close deadlocked with a hook dispatching")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 4 {
+		t.Errorf("hooks called %d times, want 4", calls)
+	}
+}
+
+func TestBeforeHookVeto(t *testing.T) {
+	errVetoed := errors.New("vetoed")
+	s := storage.NewStorage(storagetest.OpenDB(t), storage.WithHooks(storage.Hooks{
+		BeforeClientSaved: func(ctx context.Context, client osin.Client) error {
+			if client.GetSecret() == "vetoed" {
+				return errVetoed
+			}
+			return nil
+		},
+		BeforeAccessRemoved: func(ctx context.Context, token string) error {
+			return errVetoed
+		},
+	}))
+	client := &osin.DefaultClient{Id: "vetoed", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveClient(&osin.DefaultClient{Id: client.Id, Secret: "vetoed", RedirectUri: client.RedirectUri}); err != errVetoed {
+		t.Fatalf("vetoed SaveClient = %v, want the veto", err)
+	}
+	if c, err := s.GetClient(client.Id); err != nil || c.GetSecret() != "secret" {
+		t.Errorf("client after vetoed SaveClient = %v, %v, want it unchanged", c, err)
+	}
+
+	data := &osin.AccessData{Client: client, AccessToken: "vetoed", ExpiresIn: 3600, Scope: "read", CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAccess(data.AccessToken); err != errVetoed {
+		t.Fatalf("vetoed RemoveAccess = %v, want the veto", err)
+	}
+	if a, err := s.LoadAccess(data.AccessToken); err != nil || a.Scope != "read" {
+		t.Errorf("access after vetoed RemoveAccess = %v, %v, want it kept", a, err)
+	}
+}
+
+func TestOnHooksOnce(t *testing.T) {
+	calls := make(map[string]int)
+	s := storage.NewStorage(storagetest.OpenDB(t), storage.WithDispatcher(storage.SyncDispatcher{}), storage.WithHooks(storage.Hooks{
+		OnClientSaved:      func(ctx context.Context, client osin.Client) { calls["OnClientSaved"]++ },
+		OnClientRemoved:    func(ctx context.Context, id string) { calls["OnClientRemoved"]++ },
+		OnAuthorizeSaved:   func(ctx context.Context, data *osin.AuthorizeData) { calls["OnAuthorizeSaved"]++ },
+		OnAuthorizeRemoved: func(ctx context.Context, code string) { calls["OnAuthorizeRemoved"]++ },
+		OnAccessSaved:      func(ctx context.Context, data *osin.AccessData) { calls["OnAccessSaved"]++ },
+		OnAccessRemoved:    func(ctx context.Context, token string) { calls["OnAccessRemoved"]++ },
+		OnRefreshRemoved:   func(ctx context.Context, token string) { calls["OnRefreshRemoved"]++ },
+	}))
+	client := &osin.DefaultClient{Id: "once", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	authorize := &osin.AuthorizeData{Client: client, Code: "once", ExpiresIn: 600, RedirectUri: client.RedirectUri, CreatedAt: time.Now()}
+	access := &osin.AccessData{Client: client, AccessToken: "once", ExpiresIn: 3600, CreatedAt: time.Now()}
+	refresh := &osin.AccessData{Client: client, AccessToken: "once-2", RefreshToken: "once", ExpiresIn: 3600, CreatedAt: time.Now()}
+	for _, mutate := range []func() error{
+		func() error { return s.SaveClient(client) },
+		func() error { return s.SaveAuthorize(authorize) },
+		func() error { return s.RemoveAuthorize(authorize.Code) },
+		func() error { return s.SaveAccess(access) },
+		func() error { return s.RemoveAccess(access.AccessToken) },
+		func() error { return s.SaveAccess(refresh) },
+		func() error { return s.RemoveRefresh(refresh.RefreshToken) },
+		func() error { return s.RemoveClient(client.Id) },
+	} {
+		if err := mutate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// removing what is gone calls no hook
+	s.RemoveAuthorize(authorize.Code)
+	s.RemoveAccess(access.AccessToken)
+
+	want := map[string]int{
+		"OnClientSaved": 1, "OnClientRemoved": 1, "OnAuthorizeSaved": 1, "OnAuthorizeRemoved": 1,
+		"OnAccessSaved": 2, "OnAccessRemoved": 1, "OnRefreshRemoved": 1,
+	}
+	for name, n := range want {
+		if calls[name] != n {
+			t.Errorf("%s called %d times, want %d", name, calls[name], n)
+		}
+	}
+}
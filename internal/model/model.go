@@ -0,0 +1,119 @@
+// Package model holds the parts of the storage models that do not depend on gorm,
+// shared by storage.Storage and the backends that must not link it.
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by the Remove methods when nothing matched
+var ErrNotFound = errors.New("storage: not found")
+
+// ErrInvalidJWT is returned for JWT access tokens that cannot be verified
+var ErrInvalidJWT = errors.New("storage: invalid JWT")
+
+// OpenIDRequest holds the OpenID Connect parameters of an authorization request.
+// It is persisted with Authorize and carried into Access.
+type OpenIDRequest struct {
+	Subject  string     // Authenticated end-user, sub claim
+	Nonce    string     // nonce from request
+	AuthTime *time.Time // Time the end-user authenticated
+	ACR      string     // Authentication context class reference satisfied
+	MaxAge   int32      // max_age from request in seconds, 0 when absent
+	Claims   string     `gorm:"type:text"` // claims request parameter, JSON encoded
+}
+
+// IsZero reports whether r holds no OpenID Connect parameter
+func (r *OpenIDRequest) IsZero() bool {
+	return *r == OpenIDRequest{}
+}
+
+// OpenIDUserData is set as the osin UserData of an authorization request
+// to persist its OpenID Connect parameters. UserData is stored like any other UserData.
+// Loaded authorize and access data carrying OpenID Connect parameters have an *OpenIDUserData
+// as their UserData, osin copies it from the authorize data to the access data.
+type OpenIDUserData struct {
+	OpenIDRequest
+	UserData interface{}
+}
+
+// SplitUserData separates the OpenID Connect parameters from the rest of userData
+func SplitUserData(userData interface{}) (OpenIDRequest, interface{}) {
+	switch ud := userData.(type) {
+	case *OpenIDUserData:
+		return ud.OpenIDRequest, ud.UserData
+	case OpenIDUserData:
+		return ud.OpenIDRequest, ud.UserData
+	}
+	return OpenIDRequest{}, userData
+}
+
+// JoinUserData reverses SplitUserData for stored data
+func JoinUserData(oid OpenIDRequest, userData string) interface{} {
+	var ud interface{}
+	if userData != "" {
+		ud = userData
+	}
+	if oid.IsZero() {
+		return ud
+	}
+	return &OpenIDUserData{OpenIDRequest: oid, UserData: ud}
+}
+
+// UserDataToString encodes userData for storage: strings are kept as is, other values are JSON encoded
+func UserDataToString(userData interface{}) (string, error) {
+	if userData == nil {
+		return "", nil
+	}
+	if s, ok := userData.(string); ok {
+		return s, nil
+	}
+	v, err := json.Marshal(userData)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// NormalizeScope sorts the space delimited scope and removes duplicates
+func NormalizeScope(scope string) string {
+	fields := strings.Fields(scope)
+	sort.Strings(fields)
+	n := 0
+	for i, s := range fields {
+		if i == 0 || s != fields[n-1] {
+			fields[n] = s
+			n++
+		}
+	}
+	return strings.Join(fields[:n], " ")
+}
+
+// IsJWT reports whether token looks like a compact JWS
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// AccessTokenID returns the key access data is stored under, the jti of JWT access tokens or the token itself.
+// The JWT is not verified.
+func AccessTokenID(token string) (string, error) {
+	if !IsJWT(token) {
+		return token, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if err != nil {
+		return "", ErrInvalidJWT
+	}
+	var claims struct {
+		ID string `json:"jti"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.ID == "" {
+		return "", ErrInvalidJWT
+	}
+	return claims.ID, nil
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"time"
+
+	"github.com/openshift/osin"
+)
+
+// Client is a row of oauth_client
+type Client struct {
+	ID          string
+	Secret      string
+	RedirectUri string
+	UserData    string
+}
+
+// Authorize is a row of oauth_authorize
+type Authorize struct {
+	ClientID            string
+	Code                string
+	ExpiresIn           int32
+	Scope               string
+	RedirectUri         string
+	State               string
+	CreatedAt           time.Time
+	UserData            string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	OpenIDRequest
+}
+
+// Access is a row of oauth_access
+type Access struct {
+	ClientID     string
+	Authorize    string
+	PrvAccess    string
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int32
+	Scope        string
+	RedirectUri  string
+	CreatedAt    time.Time
+	UserData     string
+	OpenIDRequest
+}
+
+// ClientFromOsin converts an osin.Client to its row
+func ClientFromOsin(c osin.Client) (Client, error) {
+	v, err := UserDataToString(c.GetUserData())
+	return Client{
+		ID:          c.GetId(),
+		Secret:      c.GetSecret(),
+		RedirectUri: c.GetRedirectUri(),
+		UserData:    v,
+	}, err
+}
+
+// ToOsin converts the row to an osin.Client
+func (c *Client) ToOsin() osin.Client {
+	return &osin.DefaultClient{
+		Id:          c.ID,
+		Secret:      c.Secret,
+		RedirectUri: c.RedirectUri,
+		UserData:    c.UserData,
+	}
+}
+
+// AuthorizeFromOsin converts osin.AuthorizeData to its row
+func AuthorizeFromOsin(data *osin.AuthorizeData) (Authorize, error) {
+	oid, userData := SplitUserData(data.UserData)
+	v, err := UserDataToString(userData)
+	return Authorize{
+		ClientID:            data.Client.GetId(),
+		Code:                data.Code,
+		ExpiresIn:           data.ExpiresIn,
+		Scope:               data.Scope,
+		RedirectUri:         data.RedirectUri,
+		State:               data.State,
+		CreatedAt:           data.CreatedAt,
+		UserData:            v,
+		CodeChallenge:       data.CodeChallenge,
+		CodeChallengeMethod: data.CodeChallengeMethod,
+		OpenIDRequest:       oid,
+	}, err
+}
+
+// ToOsin converts the row to osin.AuthorizeData using c as its client
+func (a *Authorize) ToOsin(c osin.Client) *osin.AuthorizeData {
+	return &osin.AuthorizeData{
+		Client:              c,
+		Code:                a.Code,
+		ExpiresIn:           a.ExpiresIn,
+		Scope:               a.Scope,
+		RedirectUri:         a.RedirectUri,
+		State:               a.State,
+		CreatedAt:           a.CreatedAt,
+		UserData:            JoinUserData(a.OpenIDRequest, a.UserData),
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
+	}
+}
+
+// AccessFromOsin converts osin.AccessData to its row, keeping the access token as given
+func AccessFromOsin(data *osin.AccessData) (Access, error) {
+	oid, userData := SplitUserData(data.UserData)
+	v, err := UserDataToString(userData)
+	a := Access{
+		ClientID:      data.Client.GetId(),
+		AccessToken:   data.AccessToken,
+		RefreshToken:  data.RefreshToken,
+		ExpiresIn:     data.ExpiresIn,
+		Scope:         data.Scope,
+		RedirectUri:   data.RedirectUri,
+		CreatedAt:     data.CreatedAt,
+		UserData:      v,
+		OpenIDRequest: oid,
+	}
+	if data.AccessData != nil {
+		a.PrvAccess = data.AccessData.AccessToken
+	}
+	if data.AuthorizeData != nil {
+		a.Authorize = data.AuthorizeData.Code
+	}
+	return a, err
+}
+
+// ToOsin converts the row to osin.AccessData using c as its client
+func (a *Access) ToOsin(c osin.Client) *osin.AccessData {
+	return &osin.AccessData{
+		Client:       c,
+		AccessToken:  a.AccessToken,
+		RefreshToken: a.RefreshToken,
+		ExpiresIn:    a.ExpiresIn,
+		Scope:        a.Scope,
+		RedirectUri:  a.RedirectUri,
+		CreatedAt:    a.CreatedAt,
+		UserData:     JoinUserData(a.OpenIDRequest, a.UserData),
+	}
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/gislik/gorm"
+)
+
+// purgeBatch bounds the number of keys deleted by a statement
+const purgeBatch = 500
+
+// PurgeExpired deletes the expired authorization codes and the expired access data
+// without refresh token, which cannot be used anymore, and returns how many were deleted.
+// Like the Remove methods, the Before hooks can keep data, deletions are recorded and the On hooks called.
+// Expiry is computed in Go so the whole tables are scanned, run it periodically off the request path.
+func (s *Storage) PurgeExpired() (int64, error) {
+	codes, err := s.expired(&Authorize{}, "code", "")
+	if err != nil {
+		return 0, err
+	}
+	tokens, err := s.expired(&Access{}, "access_token", "refresh_token = ''")
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.purge(codes, false)
+	if err != nil {
+		return n, err
+	}
+	m, err := s.purge(tokens, true)
+	return n + m, err
+}
+
+// expiredRow identifies an expired authorization code or access token
+type expiredRow struct {
+	key      string
+	clientID string
+	subject  string
+}
+
+// purge deletes the authorize data, or the access data when access is set, of rows in batches
+func (s *Storage) purge(rows []expiredRow, access bool) (int64, error) {
+	ctx := s.context()
+	var n int64
+	for len(rows) > 0 {
+		batch := rows
+		if len(batch) > purgeBatch {
+			batch = batch[:purgeBatch]
+		}
+		rows = rows[len(batch):]
+
+		var purged []expiredRow
+		var keys []string
+		for _, r := range batch {
+			err := s.before(func(h *Hooks) error {
+				if access && h.BeforeAccessRemoved != nil {
+					return h.BeforeAccessRemoved(ctx, r.key)
+				}
+				if !access && h.BeforeAuthorizeRemoved != nil {
+					return h.BeforeAuthorizeRemoved(ctx, r.key)
+				}
+				return nil
+			})
+			if err == nil {
+				purged = append(purged, r)
+				keys = append(keys, r.key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		var deleted int64
+		err := s.transaction(func(tx *gorm.DB) error {
+			var db *gorm.DB
+			if access {
+				db = tx.Where("access_token IN (?)", keys).Delete(&Access{})
+			} else {
+				db = tx.Where("code IN (?)", keys).Delete(&Authorize{})
+			}
+			if db.Error != nil {
+				return db.Error
+			}
+			deleted = db.RowsAffected
+			if access {
+				if err := tx.Where("access_token IN (?)", keys).Delete(&AccessScope{}).Error; err != nil {
+					return err
+				}
+			}
+			event := EventAuthorizeRemoved
+			if access {
+				event = EventAccessRemoved
+			}
+			for _, r := range purged {
+				if err := s.record(tx, event, r.clientID, r.subject, r.key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += deleted
+
+		for _, r := range purged {
+			key := r.key
+			s.after(func(h *Hooks) {
+				if access && h.OnAccessRemoved != nil {
+					h.OnAccessRemoved(ctx, key)
+				}
+				if !access && h.OnAuthorizeRemoved != nil {
+					h.OnAuthorizeRemoved(ctx, key)
+				}
+			})
+		}
+	}
+	return n, nil
+}
+
+// expired returns the expired rows of model matching where, identified by key
+func (s *Storage) expired(model interface{}, key, where string) ([]expiredRow, error) {
+	db := s.db.Model(model).Select(key + ", client_id, COALESCE(subject, ''), created_at, expires_in")
+	if where != "" {
+		db = db.Where(where)
+	}
+	rows, err := db.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var expired []expiredRow
+	for rows.Next() {
+		var (
+			r         expiredRow
+			createdAt time.Time
+			expiresIn int32
+		)
+		if err := rows.Scan(&r.key, &r.clientID, &r.subject, &createdAt, &expiresIn); err != nil {
+			return nil, err
+		}
+		if createdAt.Add(time.Duration(expiresIn) * time.Second).Before(now) {
+			expired = append(expired, r)
+		}
+	}
+	return expired, rows.Err()
+}
+
+// LiveTokens returns the number of unexpired access tokens of each client.
+// Like PurgeExpired it scans the access table.
+func (s *Storage) LiveTokens() (map[string]int64, error) {
+	rows, err := s.db.Model(&Access{}).Select("client_id, created_at, expires_in").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	live := make(map[string]int64)
+	for rows.Next() {
+		var (
+			clientID  string
+			createdAt time.Time
+			expiresIn int32
+		)
+		if err := rows.Scan(&clientID, &createdAt, &expiresIn); err != nil {
+			return nil, err
+		}
+		if createdAt.Add(time.Duration(expiresIn) * time.Second).After(now) {
+			live[clientID]++
+		}
+	}
+	return live, rows.Err()
+}
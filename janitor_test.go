@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	var removed []string
+	s := storage.NewStorage(db, storage.WithAudit(), storage.WithHooks(storage.Hooks{
+		BeforeAccessRemoved: func(ctx context.Context, token string) error {
+			if token == "kept" {
+				return storage.ErrNotFound
+			}
+			return nil
+		},
+		OnAccessRemoved: func(ctx context.Context, token string) {
+			removed = append(removed, token)
+		},
+	}))
+	client := &osin.DefaultClient{Id: "purged", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"expired", "kept", "live"} {
+		data := &osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 60, CreatedAt: time.Now()}
+		if token != "live" {
+			data.CreatedAt = data.CreatedAt.Add(-time.Hour)
+		}
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rows saved before the OpenID Connect columns were added have no subject
+	if err := db.Model(&storage.Access{}).Where("access_token = ?", "expired").Update("subject", gorm.Expr("NULL")).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.PurgeExpired(); err != nil || n != 1 {
+		t.Fatalf("PurgeExpired = %d, %v, want 1", n, err)
+	}
+	if len(removed) != 1 || removed[0] != "expired" {
+		t.Errorf("OnAccessRemoved called for %v, want expired", removed)
+	}
+	if _, err := s.LoadAccess("kept"); err != nil {
+		t.Errorf("LoadAccess of the vetoed token: %v", err)
+	}
+	var events int
+	if err := db.Model(&storage.AuditEvent{}).Where("event = ?", storage.EventAccessRemoved).Count(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 {
+		t.Errorf("%d %s audit events, want 1", events, storage.EventAccessRemoved)
+	}
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+)
+
+// JWK is a public JSON Web Key as described in rfc7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWK returns the public key of k as a JWK
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{KeyID: k.ID, Use: k.Use, Algorithm: k.Algorithm}
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = enc(pub.N.Bytes())
+		jwk.E = enc(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = pub.Curve.Params().Name
+		jwk.X = enc(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = enc(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = enc(pub)
+	}
+	return jwk
+}
+
+// JWKSHandler serves the published keys of ks as a JSON Web Key Set,
+// usually at /.well-known/jwks.json
+func JWKSHandler(ks *KeyStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, err := ks.Published()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		set := struct {
+			Keys []JWK `json:"keys"`
+		}{Keys: make([]JWK, 0, len(keys))}
+		for i := range keys {
+			set.Keys = append(set.Keys, keys[i].JWK())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(&set)
+	})
+}
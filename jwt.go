@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// ErrInvalidJWT is returned for JWT access tokens that cannot be verified
+var ErrInvalidJWT = model.ErrInvalidJWT
+
+// errNoAudience is returned by JWTAccessTokenGen without an Audience, rfc9068 requires the aud claim
+var errNoAudience = errors.New("storage: JWTAccessTokenGen needs an Audience")
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// AccessTokenClaims are the claims of a JWT access token as described in rfc9068
+type AccessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ClientID  string `json:"client_id"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+// JWTAccessTokenGen implements osin.AccessTokenGen issuing rfc9068 JWT access tokens
+// signed with the current key of Keys. Refresh tokens are generated by TokenGen.
+//
+// Storage configured with the same KeyStore saves JWT access tokens under their jti
+// and LoadAccess verifies them against the published keys, opaque access tokens keep working.
+type JWTAccessTokenGen struct {
+	Keys     *KeyStore
+	Issuer   string
+	Audience string // Resource server the tokens are for, required
+
+	// Subject returns the sub claim, the client id when nil
+	Subject func(data *osin.AccessData) string
+}
+
+// GenerateAccessToken generates a JWT access token and optionally an opaque refresh token
+func (g *JWTAccessTokenGen) GenerateAccessToken(data *osin.AccessData, generaterefresh bool) (accesstoken string, refreshtoken string, err error) {
+	if g.Audience == "" {
+		return "", "", errNoAudience
+	}
+	key, err := g.Keys.Current()
+	if err != nil {
+		return "", "", err
+	}
+	jti, err := NewToken(AccessTokenPrefix)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	claims := AccessTokenClaims{
+		Issuer:    g.Issuer,
+		Subject:   data.Client.GetId(),
+		Audience:  g.Audience,
+		ClientID:  data.Client.GetId(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Duration(data.ExpiresIn) * time.Second).Unix(),
+		ID:        jti,
+		Scope:     data.Scope,
+	}
+	if g.Subject != nil {
+		claims.Subject = g.Subject(data)
+	}
+	if accesstoken, err = signJWT(key, "at+jwt", &claims); err != nil {
+		return "", "", err
+	}
+	if generaterefresh {
+		if refreshtoken, err = NewToken(RefreshTokenPrefix); err != nil {
+			return "", "", err
+		}
+	}
+	return accesstoken, refreshtoken, nil
+}
+
+// isJWT reports whether token looks like a compact JWS
+func isJWT(token string) bool {
+	return model.IsJWT(token)
+}
+
+// accessTokenID returns the key access data is stored under, the jti of JWT access tokens or the token itself.
+// The JWT is not verified: SaveAccess is given tokens the server just issued and RemoveAccess
+// must keep working after the signing key was retired. LoadAccess uses verifyAccessToken.
+func accessTokenID(token string) (string, error) {
+	return model.AccessTokenID(token)
+}
+
+// verifyAccessToken checks the signature, the expiry and the presence of the audience of a JWT access token
+// and returns its jti
+func (s *Storage) verifyAccessToken(token string) (string, error) {
+	var claims AccessTokenClaims
+	if err := s.verifyJWT(token, &claims); err != nil {
+		return "", err
+	}
+	if claims.ID == "" || claims.Audience == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return "", ErrInvalidJWT
+	}
+	return claims.ID, nil
+}
+
+// verifyJWT checks the signature of token with the published key named by its kid and decodes its claims
+func (s *Storage) verifyJWT(token string, claims interface{}) error {
+	if s.keys == nil {
+		return ErrInvalidJWT
+	}
+	return verifyJWT(s.keys, token, claims)
+}
+
+func verifyJWT(ks *KeyStore, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidJWT
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return ErrInvalidJWT
+	}
+	key, err := ks.Key(header.KeyID)
+	if err == gorm.ErrRecordNotFound {
+		return ErrInvalidJWT
+	} else if err != nil {
+		return err
+	}
+	if header.Algorithm != key.Algorithm {
+		return ErrInvalidJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return ErrInvalidJWT
+	}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return ErrInvalidJWT
+	}
+	return nil
+}
+
+// signJWT signs claims with key
+func signJWT(key *SigningKey, typ string, claims interface{}) (string, error) {
+	header, err := encodeSegment(&jwtHeader{Algorithm: key.Algorithm, Type: typ, KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.sign([]byte(header + "." + payload))
+	if err != nil {
+		return "", err
+	}
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
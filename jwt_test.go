@@ -0,0 +1,162 @@
+package storage_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// newJWTStorage returns a storage resolving the JWT access tokens issued by the returned generator
+func newJWTStorage(t *testing.T) (*storage.Storage, *storage.KeyStore, *storage.JWTAccessTokenGen, osin.Client) {
+	db := storagetest.OpenDB(t)
+	keys, err := storage.NewKeyStore(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	s := storage.NewStorage(db, storage.WithKeyStore(keys))
+	client := &osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	return s, keys, &storage.JWTAccessTokenGen{Keys: keys, Issuer: "https://auth.example.com", Audience: "https://api.example.com"}, client
+}
+
+// issue generates and saves a JWT access token with a refresh token
+func issue(t *testing.T, s *storage.Storage, gen *storage.JWTAccessTokenGen, client osin.Client, expiresIn int32) *osin.AccessData {
+	data := &osin.AccessData{Client: client, ExpiresIn: expiresIn, CreatedAt: time.Now()}
+	var err error
+	if data.AccessToken, data.RefreshToken, err = gen.GenerateAccessToken(data, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestJWTAccessToken(t *testing.T) {
+	s, keys, gen, client := newJWTStorage(t)
+	data := issue(t, s, gen, client, 3600)
+
+	access, err := s.LoadAccess(data.AccessToken)
+	if err != nil {
+		t.Fatalf("LoadAccess: %v", err)
+	}
+	refresh, err := s.LoadRefresh(data.RefreshToken)
+	if err != nil {
+		t.Fatalf("LoadRefresh: %v", err)
+	}
+	if access.AccessToken != data.AccessToken {
+		t.Errorf("LoadAccess AccessToken = %q, want the presented JWT", access.AccessToken)
+	}
+	if refresh.AccessToken == data.AccessToken || !storage.ValidToken(storage.AccessTokenPrefix, refresh.AccessToken) {
+		t.Errorf("LoadRefresh AccessToken = %q, want the jti", refresh.AccessToken)
+	}
+
+	key, err := keys.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Retire(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadAccess(data.AccessToken); err != storage.ErrInvalidJWT {
+		t.Errorf("LoadAccess with a retired key = %v, want ErrInvalidJWT", err)
+	}
+	if err := s.RemoveAccess(data.AccessToken); err != nil {
+		t.Errorf("RemoveAccess with a retired key: %v", err)
+	}
+	if _, err := s.LoadRefresh(data.RefreshToken); err == nil {
+		t.Error("LoadRefresh after RemoveAccess succeeded")
+	}
+}
+
+func TestJWTAccessTokenExpired(t *testing.T) {
+	s, _, gen, client := newJWTStorage(t)
+	data := issue(t, s, gen, client, 0)
+
+	if _, err := s.LoadAccess(data.AccessToken); err != storage.ErrInvalidJWT {
+		t.Errorf("LoadAccess of an expired JWT = %v, want ErrInvalidJWT", err)
+	}
+}
+
+func TestJWTAccessTokenAudience(t *testing.T) {
+	s, keys, gen, client := newJWTStorage(t)
+	data := &osin.AccessData{Client: client, ExpiresIn: 3600, CreatedAt: time.Now()}
+	noAudience := &storage.JWTAccessTokenGen{Keys: keys, Issuer: gen.Issuer}
+	if _, _, err := noAudience.GenerateAccessToken(data, false); err == nil {
+		t.Error("GenerateAccessToken without Audience succeeded")
+	}
+
+	// a token signed without aud by another issuer sharing the keys is rejected
+	key, err := keys.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signedWithoutAudience(t, key, "oat_without-aud")
+	data.AccessToken = token
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadAccess(token); err != storage.ErrInvalidJWT {
+		t.Errorf("LoadAccess without aud = %v, want ErrInvalidJWT", err)
+	}
+}
+
+// signedWithoutAudience returns a JWT access token with jti signed by key, lacking the aud claim
+func signedWithoutAudience(t *testing.T, key *storage.SigningKey, jti string) string {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		t.Fatal("signing key is not PEM encoded")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := segment(map[string]string{"alg": key.Algorithm, "typ": "at+jwt", "kid": key.ID}) + "." +
+		segment(map[string]interface{}{"jti": jti, "exp": time.Now().Add(time.Hour).Unix()})
+	digest := sha256.Sum256([]byte(signingInput))
+	var sig []byte
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig, err = make([]byte, 64), e
+		if e == nil {
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signingInput))
+	default:
+		t.Fatalf("unsupported signing key %T", private)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gislik/gorm"
+)
+
+// KeyStore manages the signing keys kept in the oauth_signing_key table.
+// New keys are generated by Rotate, the previous current key stays published
+// for the Overlap window so tokens it signed can still be verified.
+type KeyStore struct {
+	db   *gorm.DB
+	aead cipher.AEAD
+
+	// Algorithm of the keys generated by Rotate, RS256 by default
+	Algorithm string
+	// Overlap is how long a replaced key stays published
+	Overlap time.Duration
+	// RotationPeriod is the age after which RotateIfDue replaces the current key
+	RotationPeriod time.Duration
+	// ErrorLog logs the keys skipped by Published, the standard logger when nil
+	ErrorLog *log.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewKeyStore returns a KeyStore on db. When kek is not nil private keys are
+// encrypted at rest with AES-GCM using kek, which must be 16, 24 or 32 bytes long.
+// The key ID is authenticated with the private key, so a sealed key cannot be moved to another row.
+func NewKeyStore(db *gorm.DB, kek []byte) (*KeyStore, error) {
+	ks := &KeyStore{
+		db:             db,
+		Algorithm:      RS256,
+		Overlap:        24 * time.Hour,
+		RotationPeriod: 30 * 24 * time.Hour,
+	}
+	if kek != nil {
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, err
+		}
+		if ks.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// Rotate generates and saves a new current key.
+// The previous current key expires after Overlap.
+func (ks *KeyStore) Rotate() (*SigningKey, error) {
+	signer, err := generateKey(ks.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := marshalKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if err = randomBase62(id); err != nil {
+		return nil, err
+	}
+	k := &SigningKey{
+		ID:        string(id),
+		Algorithm: ks.Algorithm,
+		Use:       "sig",
+		CreatedAt: time.Now(),
+		key:       signer,
+	}
+	if k.PrivateKey, k.Encrypted, err = ks.seal(k.ID, pem); err != nil {
+		return nil, err
+	}
+
+	tx := ks.db.Begin()
+	err = tx.Model(&SigningKey{}).Where("expires_at IS NULL AND retired_at IS NULL").Update("expires_at", k.CreatedAt.Add(ks.Overlap)).Error
+	if err == nil {
+		err = tx.Create(k).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return k, tx.Commit().Error
+}
+
+// RotateIfDue rotates when there is no current key or it is older than RotationPeriod
+func (ks *KeyStore) RotateIfDue() (bool, error) {
+	k, err := ks.Current()
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return false, err
+	}
+	if k != nil && time.Since(k.CreatedAt) < ks.RotationPeriod {
+		return false, nil
+	}
+	_, err = ks.Rotate()
+	return err == nil, err
+}
+
+// StartRotation calls RotateIfDue every interval until StopRotation is called.
+// Errors are passed to onError when it is not nil.
+func (ks *KeyStore) StartRotation(interval time.Duration, onError func(error)) {
+	ks.StopRotation()
+	ks.stop = make(chan struct{})
+	ks.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer ks.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := ks.RotateIfDue(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(ks.stop)
+}
+
+// StopRotation stops the rotation started by StartRotation
+func (ks *KeyStore) StopRotation() {
+	if ks.stop == nil {
+		return
+	}
+	close(ks.stop)
+	ks.wg.Wait()
+	ks.stop = nil
+}
+
+// Retire stops using and publishing the key immediately, e.g. after it was compromised
+func (ks *KeyStore) Retire(id string) error {
+	db := ks.db.Model(&SigningKey{}).Where("id = ? AND retired_at IS NULL", id).Update("retired_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Current returns the key new tokens are signed with
+func (ks *KeyStore) Current() (*SigningKey, error) {
+	var k SigningKey
+	err := ks.db.Where("expires_at IS NULL AND retired_at IS NULL").Order("created_at desc").First(&k).Error
+	if err != nil {
+		return nil, err
+	}
+	return &k, ks.open(&k)
+}
+
+// Key loads a published key by id (kid)
+func (ks *KeyStore) Key(id string) (*SigningKey, error) {
+	var k SigningKey
+	err := ks.db.Where("id = ? AND retired_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", id, time.Now()).First(&k).Error
+	if err != nil {
+		return nil, err
+	}
+	return &k, ks.open(&k)
+}
+
+// Published returns the current key and the replaced keys still within their overlap window.
+// Keys that cannot be decrypted or parsed are logged to ErrorLog and skipped.
+func (ks *KeyStore) Published() ([]SigningKey, error) {
+	var keys []SigningKey
+	err := ks.db.Where("retired_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now()).Order("created_at desc").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	published := keys[:0]
+	for _, k := range keys {
+		if err := ks.open(&k); err != nil {
+			ks.logf("storage: skipping signing key %s: %v", k.ID, err)
+			continue
+		}
+		published = append(published, k)
+	}
+	return published, nil
+}
+
+func (ks *KeyStore) logf(format string, args ...interface{}) {
+	if ks.ErrorLog != nil {
+		ks.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// seal encrypts the private key PEM of key id when the KeyStore has a key encryption key
+func (ks *KeyStore) seal(id string, pem []byte) (string, bool, error) {
+	if ks.aead == nil {
+		return string(pem), false, nil
+	}
+	nonce := make([]byte, ks.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", false, err
+	}
+	return base64.StdEncoding.EncodeToString(ks.aead.Seal(nonce, nonce, pem, []byte(id))), true, nil
+}
+
+// open decrypts and parses the private key of k
+func (ks *KeyStore) open(k *SigningKey) error {
+	pem := []byte(k.PrivateKey)
+	if k.Encrypted {
+		if ks.aead == nil {
+			return errors.New("storage: signing key is encrypted and no key encryption key is set")
+		}
+		b, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+		if err != nil {
+			return err
+		}
+		n := ks.aead.NonceSize()
+		if len(b) < n {
+			return errors.New("storage: invalid encrypted signing key")
+		}
+		if pem, err = ks.aead.Open(nil, b[:n], b[n:], []byte(k.ID)); err != nil {
+			return err
+		}
+	}
+	key, err := parseKey(pem)
+	if err != nil {
+		return err
+	}
+	k.key = key
+	return nil
+}
@@ -0,0 +1,45 @@
+package storage_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+)
+
+func TestKeyStoreSkipsBadKeys(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	keys, err := storage.NewKeyStore(db, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	keys.ErrorLog = log.New(&logged, "", 0)
+	old, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sealed private key is bound to its key ID
+	err = db.Model(&storage.SigningKey{}).Where("id = ?", old.ID).Update("private_key", current.PrivateKey).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := keys.Published()
+	if err != nil {
+		t.Fatalf("Published: %v", err)
+	}
+	if len(published) != 1 || published[0].ID != current.ID {
+		t.Errorf("Published = %d keys, want only %s", len(published), current.ID)
+	}
+	if !strings.Contains(logged.String(), old.ID) {
+		t.Errorf("skipped key %s not logged: %q", old.ID, logged.String())
+	}
+}
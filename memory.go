@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gislik/gorm"
+	"github.com/openshift/osin"
+)
+
+// MemoryStorage keeps clients, authorize and access data in memory with the same
+// semantics as Storage. It is safe for concurrent use.
+type MemoryStorage struct {
+	idempotent bool
+	validate   bool
+
+	mu        sync.RWMutex
+	clients   map[string]Client
+	authorize map[string]Authorize
+	access    map[string]Access
+	refresh   map[string]string // refresh token to access token
+}
+
+// memorySnapshot is the on-disk representation of a MemoryStorage
+type memorySnapshot struct {
+	Clients   []Client
+	Authorize []Authorize
+	Access    []Access
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+// IdempotentRemove and ValidateTokens are the options applying to it. It panics when given
+// WithKeyStore, WithHooks, WithDispatcher, WithAudit or WithOutbox, which need a database.
+func NewMemoryStorage(opts ...Option) *MemoryStorage {
+	var o Storage
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.keys != nil || o.hooks != nil || o.dispatcher != nil || o.audit || o.outbox {
+		panic("storage: MemoryStorage only supports the IdempotentRemove and ValidateTokens options")
+	}
+	return &MemoryStorage{
+		idempotent: o.idempotent,
+		validate:   o.validate,
+		clients:    make(map[string]Client),
+		authorize:  make(map[string]Authorize),
+		access:     make(map[string]Access),
+		refresh:    make(map[string]string),
+	}
+}
+
+// Clone the storage if needed.
+func (s *MemoryStorage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds
+func (s *MemoryStorage) Close() {
+}
+
+// GetClient loads the client by id (client_id)
+func (s *MemoryStorage) GetClient(id string) (osin.Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return c.ToOsin(), nil
+}
+
+// SaveClient saves client
+func (s *MemoryStorage) SaveClient(c osin.Client) error {
+	client, err := ClientFromOsin(c)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[client.ID]; ok {
+		return fmt.Errorf("storage: client %q already exists", client.ID)
+	}
+	s.clients[client.ID] = client
+	return nil
+}
+
+// RemoveClient removes the client with matching id
+func (s *MemoryStorage) RemoveClient(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[id]; !ok {
+		return s.notFound()
+	}
+	delete(s.clients, id)
+	return nil
+}
+
+// SaveAuthorize saves authorize data.
+func (s *MemoryStorage) SaveAuthorize(data *osin.AuthorizeData) error {
+	authorize, err := AuthorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authorize[authorize.Code]; ok {
+		return fmt.Errorf("storage: authorize code already exists")
+	}
+	s.authorize[authorize.Code] = authorize
+	return nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *MemoryStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	if s.validate && !ValidToken(AuthorizeTokenPrefix, code) {
+		return nil, ErrMalformedToken
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	authorize, ok := s.authorize[code]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	client, ok := s.clients[authorize.ClientID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return authorize.ToOsin(client.ToOsin()), nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *MemoryStorage) RemoveAuthorize(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authorize[code]; !ok {
+		return s.notFound()
+	}
+	delete(s.authorize, code)
+	return nil
+}
+
+// SaveAccess writes AccessData.
+func (s *MemoryStorage) SaveAccess(data *osin.AccessData) error {
+	access, err := AccessFromOsin(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.access[access.AccessToken]; ok {
+		return fmt.Errorf("storage: access token already exists")
+	}
+	s.access[access.AccessToken] = access
+	if access.RefreshToken != "" {
+		s.refresh[access.RefreshToken] = access.AccessToken
+	}
+	return nil
+}
+
+// LoadAccess retrieves access data by token.
+func (s *MemoryStorage) LoadAccess(code string) (*osin.AccessData, error) {
+	if s.validate && !ValidToken(AccessTokenPrefix, code) {
+		return nil, ErrMalformedToken
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.loadAccess(code)
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *MemoryStorage) RemoveAccess(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeAccess(code)
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *MemoryStorage) LoadRefresh(code string) (*osin.AccessData, error) {
+	if s.validate && !ValidToken(RefreshTokenPrefix, code) {
+		return nil, ErrMalformedToken
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.refresh[code]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return s.loadAccess(token)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *MemoryStorage) RemoveRefresh(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[code]
+	if !ok {
+		return s.notFound()
+	}
+	return s.removeAccess(token)
+}
+
+// Snapshot writes the storage content to the file at path.
+// The file is replaced atomically.
+func (s *MemoryStorage) Snapshot(path string) error {
+	s.mu.RLock()
+	snapshot := memorySnapshot{}
+	for _, c := range s.clients {
+		snapshot.Clients = append(snapshot.Clients, c)
+	}
+	for _, a := range s.authorize {
+		snapshot.Authorize = append(snapshot.Authorize, a)
+	}
+	for _, a := range s.access {
+		snapshot.Access = append(snapshot.Access, a)
+	}
+	s.mu.RUnlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = json.NewEncoder(f).Encode(&snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Restore replaces the storage content with the snapshot at path
+func (s *MemoryStorage) Restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snapshot memorySnapshot
+	if err = json.NewDecoder(f).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients = make(map[string]Client, len(snapshot.Clients))
+	s.authorize = make(map[string]Authorize, len(snapshot.Authorize))
+	s.access = make(map[string]Access, len(snapshot.Access))
+	s.refresh = make(map[string]string)
+	for _, c := range snapshot.Clients {
+		s.clients[c.ID] = c
+	}
+	for _, a := range snapshot.Authorize {
+		s.authorize[a.Code] = a
+	}
+	for _, a := range snapshot.Access {
+		s.access[a.AccessToken] = a
+		if a.RefreshToken != "" {
+			s.refresh[a.RefreshToken] = a.AccessToken
+		}
+	}
+	return nil
+}
+
+// loadAccess must be called with s.mu held
+func (s *MemoryStorage) loadAccess(token string) (*osin.AccessData, error) {
+	a, ok := s.access[token]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	c, ok := s.clients[a.ClientID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	client := c.ToOsin()
+	oa := a.ToOsin(client)
+	if authorize, ok := s.authorize[a.Authorize]; ok {
+		if authorize.ClientID == a.ClientID {
+			oa.AuthorizeData = authorize.ToOsin(client)
+		} else if c, ok := s.clients[authorize.ClientID]; ok {
+			oa.AuthorizeData = authorize.ToOsin(c.ToOsin())
+		}
+	}
+	return oa, nil
+}
+
+// removeAccess must be called with s.mu held for writing
+func (s *MemoryStorage) removeAccess(token string) error {
+	a, ok := s.access[token]
+	if !ok {
+		return s.notFound()
+	}
+	delete(s.access, token)
+	if a.RefreshToken != "" {
+		delete(s.refresh, a.RefreshToken)
+	}
+	return nil
+}
+
+// notFound is the result of removing a missing entity, nil with IdempotentRemove
+func (s *MemoryStorage) notFound() error {
+	if s.idempotent {
+		return nil
+	}
+	return ErrNotFound
+}
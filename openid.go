@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// OpenIDRequest holds the OpenID Connect parameters of an authorization request.
+// It is persisted with Authorize and carried into Access.
+type OpenIDRequest = model.OpenIDRequest
+
+// NewOpenIDRequest reads the OpenID Connect parameters of the authorization request r
+// for subject, who authenticated now. A claims request that does not parse is ignored.
+func NewOpenIDRequest(r *http.Request, subject string) OpenIDRequest {
+	now := time.Now()
+	oid := OpenIDRequest{
+		Subject:  subject,
+		Nonce:    r.FormValue("nonce"),
+		AuthTime: &now,
+	}
+	if claims := r.FormValue("claims"); claims != "" {
+		if _, err := ParseClaimsRequest(claims); err == nil {
+			oid.Claims = claims
+		}
+	}
+	if acr := strings.Fields(r.FormValue("acr_values")); len(acr) > 0 {
+		oid.ACR = acr[0]
+	}
+	if maxAge, err := strconv.ParseInt(r.FormValue("max_age"), 10, 32); err == nil && maxAge > 0 {
+		oid.MaxAge = int32(maxAge)
+	}
+	return oid
+}
+
+// OpenIDUserData is set as the osin UserData of an authorization request
+// to persist its OpenID Connect parameters. UserData is stored like any other UserData.
+// Loaded authorize and access data carrying OpenID Connect parameters have an *OpenIDUserData
+// as their UserData, osin copies it from the authorize data to the access data.
+type OpenIDUserData = model.OpenIDUserData
+
+// OpenID returns the OpenID Connect parameters carried by userData
+func OpenID(userData interface{}) (OpenIDRequest, bool) {
+	oid, _ := model.SplitUserData(userData)
+	return oid, !oid.IsZero()
+}
+
+// ClaimsRequest is the claims request parameter of OpenID Connect Core 1.0 section 5.5,
+// the claims requested by name for the userinfo endpoint and the ID token
+type ClaimsRequest struct {
+	UserInfo map[string]*ClaimRequest `json:"userinfo,omitempty"`
+	IDToken  map[string]*ClaimRequest `json:"id_token,omitempty"`
+}
+
+// ClaimRequest qualifies a requested claim, it is nil for claims requested by name only
+type ClaimRequest struct {
+	Essential bool          `json:"essential,omitempty"`
+	Value     interface{}   `json:"value,omitempty"`
+	Values    []interface{} `json:"values,omitempty"`
+}
+
+// ParseClaimsRequest decodes the JSON encoded claims request parameter, nil when empty
+func ParseClaimsRequest(claims string) (*ClaimsRequest, error) {
+	if claims == "" {
+		return nil, nil
+	}
+	var c ClaimsRequest
+	if err := json.Unmarshal([]byte(claims), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// requestedClaims returns the sorted names of the claims requested by oid for the userinfo endpoint
+// or, when idToken is set, for the ID token
+func requestedClaims(oid OpenIDRequest, idToken bool) []string {
+	c, err := ParseClaimsRequest(oid.Claims)
+	if err != nil || c == nil {
+		return nil
+	}
+	m := c.UserInfo
+	if idToken {
+		m = c.IDToken
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ClaimsFunc returns the claims of subject released for scope together with the claims
+// named by requested, the members of the claims request for the userinfo endpoint or the ID token
+type ClaimsFunc func(subject, scope string, requested []string) (map[string]interface{}, error)
+
+// IDTokenClaims are the claims of an ID token
+type IDTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	AuthTime  int64  `json:"auth_time,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	ACR       string `json:"acr,omitempty"`
+	AtHash    string `json:"at_hash,omitempty"`
+}
+
+// IDTokenGen issues OpenID Connect ID tokens signed with the current key of Keys
+type IDTokenGen struct {
+	Keys       *KeyStore
+	Issuer     string
+	Expiration time.Duration // Lifetime of ID tokens, an hour when zero
+
+	// Claims returns the claims requested for the ID token by the claims request parameter,
+	// it is called with an empty scope since scope claims are served by the userinfo endpoint.
+	// Claims that were not requested are dropped. ID tokens carry no end-user claims when nil.
+	Claims ClaimsFunc
+}
+
+// GenerateIDToken generates an ID token for access data carrying OpenID Connect parameters
+func (g *IDTokenGen) GenerateIDToken(data *osin.AccessData) (string, error) {
+	oid, ok := OpenID(data.UserData)
+	if !ok || oid.Subject == "" {
+		return "", errors.New("storage: access data carries no OpenID Connect subject")
+	}
+	key, err := g.Keys.Current()
+	if err != nil {
+		return "", err
+	}
+	expiration := g.Expiration
+	if expiration == 0 {
+		expiration = time.Hour
+	}
+	now := time.Now()
+	claims := IDTokenClaims{
+		Issuer:    g.Issuer,
+		Subject:   oid.Subject,
+		Audience:  data.Client.GetId(),
+		ExpiresAt: now.Add(expiration).Unix(),
+		IssuedAt:  now.Unix(),
+		Nonce:     oid.Nonce,
+		ACR:       oid.ACR,
+		AtHash:    tokenHash(key.Algorithm, data.AccessToken),
+	}
+	if oid.AuthTime != nil {
+		claims.AuthTime = oid.AuthTime.Unix()
+	}
+	requested := requestedClaims(oid, true)
+	if g.Claims == nil || len(requested) == 0 {
+		return signJWT(key, "JWT", &claims)
+	}
+	extra, err := g.Claims(oid.Subject, "", requested)
+	if err != nil {
+		return "", err
+	}
+	payload, err := mergeClaims(&claims, extra, requested)
+	if err != nil {
+		return "", err
+	}
+	return signJWT(key, "JWT", payload)
+}
+
+// mergeClaims adds the claims of extra named by requested to the registered claims,
+// which take precedence
+func mergeClaims(registered interface{}, extra map[string]interface{}, requested []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(registered)
+	if err != nil {
+		return nil, err
+	}
+	payload := make(map[string]interface{})
+	for _, name := range requested {
+		if v, ok := extra[name]; ok {
+			payload[name] = v
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// FinishIDToken adds an id_token to a successful token response of osin
+// when the issued access token has the openid scope and carries OpenID Connect parameters.
+// s loads the issued access data.
+func (g *IDTokenGen) FinishIDToken(resp *osin.Response, s osin.Storage) error {
+	if resp.IsError {
+		return nil
+	}
+	token, _ := resp.Output["access_token"].(string)
+	if token == "" {
+		return nil
+	}
+	data, err := s.LoadAccess(token)
+	if err != nil {
+		return err
+	}
+	if _, ok := OpenID(data.UserData); !ok || !hasScope(data.Scope, "openid") {
+		return nil
+	}
+	idToken, err := g.GenerateIDToken(data)
+	if err != nil {
+		return err
+	}
+	resp.Output["id_token"] = idToken
+	return nil
+}
+
+// tokenHash returns the at_hash of token for the JWS algorithm alg
+func tokenHash(alg, token string) string {
+	var h hash.Hash
+	if alg == EdDSA {
+		h = sha512.New()
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(token))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// hasScope reports whether the space delimited scope contains s
+func hasScope(scope, s string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// UserInfoHandler serves the OpenID Connect userinfo endpoint.
+// The subject is resolved from the bearer access token with s.LoadAccess,
+// claims returns the claims released for subject and scope and those requested for the userinfo endpoint
+// by the claims request parameter of the authorization request.
+func UserInfoHandler(s osin.Storage, claims ClaimsFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("access_token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		storage := s.Clone()
+		defer storage.Close()
+
+		data, err := storage.LoadAccess(token)
+		if err != nil || data.IsExpired() {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		oid, ok := OpenID(data.UserData)
+		if !ok || oid.Subject == "" || !hasScope(data.Scope, "openid") {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var info map[string]interface{}
+		if claims != nil {
+			if info, err = claims(oid.Subject, data.Scope, requestedClaims(oid, false)); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		if info == nil {
+			info = make(map[string]interface{})
+		}
+		info["sub"] = oid.Subject
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(info)
+	})
+}
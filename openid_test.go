@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+)
+
+// userClaims releases the claims named by requested, and all of them for the profile scope
+func userClaims(subject, scope string, requested []string) (map[string]interface{}, error) {
+	user := map[string]interface{}{"name": "Jane", "email": "jane@example.com"}
+	if scope == "openid profile" {
+		return user, nil
+	}
+	released := make(map[string]interface{})
+	for _, name := range requested {
+		if v, ok := user[name]; ok {
+			released[name] = v
+		}
+	}
+	return released, nil
+}
+
+func TestClaimsRequest(t *testing.T) {
+	s, keys, _, client := newJWTStorage(t)
+	query := url.Values{"claims": {`{"userinfo":{"email":null},"id_token":{"name":{"essential":true}}}`}}
+	r := httptest.NewRequest("GET", "/authorize?"+query.Encode(), nil)
+	data := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresIn:    3600,
+		Scope:        "openid",
+		CreatedAt:    time.Now(),
+		UserData:     &storage.OpenIDUserData{OpenIDRequest: storage.NewOpenIDRequest(r, "subject")},
+	}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer access")
+	storage.UserInfoHandler(s, userClaims).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("userinfo status = %d", w.Code)
+	}
+	var info map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info["sub"] != "subject" || info["email"] != "jane@example.com" || info["name"] != nil {
+		t.Errorf("userinfo = %v, want sub and email", info)
+	}
+
+	gen := &storage.IDTokenGen{Keys: keys, Issuer: "https://auth.example.com", Claims: userClaims}
+	idToken, err := gen.GenerateIDToken(data)
+	if err != nil {
+		t.Fatalf("GenerateIDToken: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(idToken, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "subject" || claims["name"] != "Jane" || claims["email"] != nil {
+		t.Errorf("ID token claims = %v, want sub and name", claims)
+	}
+}
@@ -0,0 +1,79 @@
+package otelstorage
+
+import (
+	"context"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const spanKey = "otelstorage:span"
+
+// RegisterCallbacks traces the queries of db run with a context, i.e. by a storage.Storage
+// returned by WithContext. Spans carry the table and the statement with its placeholders,
+// query arguments such as tokens are not recorded.
+// gorm callbacks are shared by the DBs opened by the process, call it once.
+func RegisterCallbacks(db *gorm.DB, tp trace.TracerProvider) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(instrumentation)
+
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("otelstorage:before_create", before(tracer, "create"))
+	cb.Create().After("gorm:create").Register("otelstorage:after_create", after)
+	cb.Query().Before("gorm:query").Register("otelstorage:before_query", before(tracer, "query"))
+	cb.Query().After("gorm:query").Register("otelstorage:after_query", after)
+	cb.RowQuery().Before("gorm:row_query").Register("otelstorage:before_row_query", before(tracer, "row_query"))
+	cb.RowQuery().After("gorm:row_query").Register("otelstorage:after_row_query", after)
+	cb.Update().Before("gorm:update").Register("otelstorage:before_update", before(tracer, "update"))
+	cb.Update().After("gorm:update").Register("otelstorage:after_update", after)
+	cb.Delete().Before("gorm:delete").Register("otelstorage:before_delete", before(tracer, "delete"))
+	cb.Delete().After("gorm:delete").Register("otelstorage:after_delete", after)
+}
+
+func before(tracer trace.Tracer, operation string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		v, ok := scope.Get(storage.ContextKey)
+		if !ok {
+			return
+		}
+		ctx, ok := v.(context.Context)
+		if !ok {
+			return
+		}
+		table := scope.TableName()
+		_, span := tracer.Start(ctx, "gorm."+operation+" "+table,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				OperationKey.String(operation),
+				attribute.String("db.sql.table", table),
+			),
+		)
+		scope.InstanceSet(spanKey, span)
+	}
+}
+
+func after(scope *gorm.Scope) {
+	v, ok := scope.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := v.(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("db.statement", scope.SQL),
+		attribute.Int64("db.rows_affected", scope.DB().RowsAffected),
+	)
+	if err := scope.DB().Error; err != nil && err != gorm.ErrRecordNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,242 @@
+// Package otelstorage traces osin.Storage calls and the gorm queries they run with OpenTelemetry.
+//
+// Spans carry the operation and the client ID when known, never tokens.
+// The parent span is taken from the context passed to WithContext, usually the request context.
+//
+// Besides the osin.Storage methods, SaveClient, RemoveClient, RevokeByScope, PurgeExpired and LiveTokens
+// are forwarded to the wrapped storage when it implements them. Call its other methods, e.g. the device
+// and pushed request methods of storage.Storage, on the wrapped storage itself: with a storage.Storage
+// returned by WithContext their queries are still traced by RegisterCallbacks.
+package otelstorage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	gormv2 "gorm.io/gorm"
+)
+
+const instrumentation = "github.com/gislik/osin-storage/otelstorage"
+
+// Span attributes
+const (
+	OperationKey = attribute.Key("osin.storage.operation")
+	ClientIDKey  = attribute.Key("oauth.client_id")
+)
+
+// ContextStorage is implemented by storages running their calls with a context,
+// like storage.Storage and gormv2.Storage
+type ContextStorage interface {
+	StorageWithContext(ctx context.Context) osin.Storage
+}
+
+// Storage wraps an osin.Storage with a span around each call
+type Storage struct {
+	osin.Storage
+	tracer trace.Tracer
+	ctx    context.Context
+}
+
+// New returns s traced with the tracers of tp, the global provider when nil.
+// When s is a ContextStorage the context of the span is passed to it,
+// so the gorm queries traced by RegisterCallbacks are children of the span.
+func New(s osin.Storage, tp trace.TracerProvider) *Storage {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Storage{Storage: s, tracer: tp.Tracer(instrumentation), ctx: context.Background()}
+}
+
+// WithContext returns a copy of the storage whose spans are children of the span of ctx
+func (s *Storage) WithContext(ctx context.Context) *Storage {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// Clone clones the wrapped storage
+func (s *Storage) Clone() osin.Storage {
+	c := *s
+	c.Storage = s.Storage.Clone()
+	return &c
+}
+
+// start starts the span of operation and returns the wrapped storage using its context
+func (s *Storage) start(operation string, clientID string) (osin.Storage, trace.Span) {
+	attrs := []attribute.KeyValue{OperationKey.String(operation)}
+	if clientID != "" {
+		attrs = append(attrs, ClientIDKey.String(clientID))
+	}
+	ctx, span := s.tracer.Start(s.ctx, "storage."+operation, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attrs...))
+	if st, ok := s.Storage.(ContextStorage); ok {
+		return st.StorageWithContext(ctx), span
+	}
+	return s.Storage, span
+}
+
+// end ends span recording err. Missing data is not an error of the storage.
+func end(span trace.Span, err error) {
+	if err != nil && !notFound(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// notFound reports whether err is storage.ErrNotFound or the missing row error of gorm v1 or v2
+func notFound(err error) bool {
+	return errors.Is(err, storage.ErrNotFound) || errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, gormv2.ErrRecordNotFound)
+}
+
+// GetClient loads the client by id
+func (s *Storage) GetClient(id string) (c osin.Client, err error) {
+	st, span := s.start("GetClient", id)
+	defer func() { end(span, err) }()
+	return st.GetClient(id)
+}
+
+// SaveAuthorize saves authorize data
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	st, span := s.start("SaveAuthorize", data.Client.GetId())
+	defer func() { end(span, err) }()
+	return st.SaveAuthorize(data)
+}
+
+// LoadAuthorize looks up authorize data by code
+func (s *Storage) LoadAuthorize(code string) (data *osin.AuthorizeData, err error) {
+	st, span := s.start("LoadAuthorize", "")
+	defer func() {
+		if data != nil && data.Client != nil {
+			span.SetAttributes(ClientIDKey.String(data.Client.GetId()))
+		}
+		end(span, err)
+	}()
+	return st.LoadAuthorize(code)
+}
+
+// RemoveAuthorize revokes or deletes the authorization code
+func (s *Storage) RemoveAuthorize(code string) (err error) {
+	st, span := s.start("RemoveAuthorize", "")
+	defer func() { end(span, err) }()
+	return st.RemoveAuthorize(code)
+}
+
+// SaveAccess writes access data
+func (s *Storage) SaveAccess(data *osin.AccessData) (err error) {
+	st, span := s.start("SaveAccess", data.Client.GetId())
+	defer func() { end(span, err) }()
+	return st.SaveAccess(data)
+}
+
+// LoadAccess retrieves access data by token
+func (s *Storage) LoadAccess(token string) (data *osin.AccessData, err error) {
+	st, span := s.start("LoadAccess", "")
+	defer func() {
+		if data != nil && data.Client != nil {
+			span.SetAttributes(ClientIDKey.String(data.Client.GetId()))
+		}
+		end(span, err)
+	}()
+	return st.LoadAccess(token)
+}
+
+// RemoveAccess revokes or deletes access data
+func (s *Storage) RemoveAccess(token string) (err error) {
+	st, span := s.start("RemoveAccess", "")
+	defer func() { end(span, err) }()
+	return st.RemoveAccess(token)
+}
+
+// LoadRefresh retrieves refresh access data
+func (s *Storage) LoadRefresh(token string) (data *osin.AccessData, err error) {
+	st, span := s.start("LoadRefresh", "")
+	defer func() {
+		if data != nil && data.Client != nil {
+			span.SetAttributes(ClientIDKey.String(data.Client.GetId()))
+		}
+		end(span, err)
+	}()
+	return st.LoadRefresh(token)
+}
+
+// RemoveRefresh revokes or deletes refresh access data
+func (s *Storage) RemoveRefresh(token string) (err error) {
+	st, span := s.start("RemoveRefresh", "")
+	defer func() { end(span, err) }()
+	return st.RemoveRefresh(token)
+}
+
+type clientSaver interface {
+	SaveClient(c osin.Client) error
+	RemoveClient(id string) error
+}
+
+type scopeRevoker interface {
+	RevokeByScope(scope string) (int64, error)
+}
+
+// SaveClient saves the client when the wrapped storage implements SaveClient, like storage.Storage
+func (s *Storage) SaveClient(c osin.Client) (err error) {
+	if _, ok := s.Storage.(clientSaver); !ok {
+		return errors.New("otelstorage: wrapped storage cannot save clients")
+	}
+	st, span := s.start("SaveClient", c.GetId())
+	defer func() { end(span, err) }()
+	return st.(clientSaver).SaveClient(c)
+}
+
+// RemoveClient removes the client when the wrapped storage implements RemoveClient, like storage.Storage
+func (s *Storage) RemoveClient(id string) (err error) {
+	if _, ok := s.Storage.(clientSaver); !ok {
+		return errors.New("otelstorage: wrapped storage cannot remove clients")
+	}
+	st, span := s.start("RemoveClient", id)
+	defer func() { end(span, err) }()
+	return st.(clientSaver).RemoveClient(id)
+}
+
+// RevokeByScope removes the access data having scope when the wrapped storage implements RevokeByScope,
+// like storage.Storage
+func (s *Storage) RevokeByScope(scope string) (n int64, err error) {
+	if _, ok := s.Storage.(scopeRevoker); !ok {
+		return 0, errors.New("otelstorage: wrapped storage cannot revoke by scope")
+	}
+	st, span := s.start("RevokeByScope", "")
+	defer func() { end(span, err) }()
+	return st.(scopeRevoker).RevokeByScope(scope)
+}
+
+type purger interface {
+	PurgeExpired() (int64, error)
+}
+
+type liveTokenCounter interface {
+	LiveTokens() (map[string]int64, error)
+}
+
+// PurgeExpired purges the wrapped storage when it implements PurgeExpired, like storage.Storage
+func (s *Storage) PurgeExpired() (n int64, err error) {
+	if _, ok := s.Storage.(purger); !ok {
+		return 0, nil
+	}
+	st, span := s.start("PurgeExpired", "")
+	defer func() { end(span, err) }()
+	return st.(purger).PurgeExpired()
+}
+
+// LiveTokens counts the live tokens of the wrapped storage when it implements LiveTokens, like storage.Storage
+func (s *Storage) LiveTokens() (live map[string]int64, err error) {
+	if _, ok := s.Storage.(liveTokenCounter); !ok {
+		return nil, nil
+	}
+	st, span := s.start("LiveTokens", "")
+	defer func() { end(span, err) }()
+	return st.(liveTokenCounter).LiveTokens()
+}
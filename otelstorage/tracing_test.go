@@ -0,0 +1,179 @@
+package otelstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	gormv2 "gorm.io/gorm"
+)
+
+// newRecorder returns a tracer provider recording its ended spans in the returned recorder
+func newRecorder(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp, sr
+}
+
+// attr returns the value of the attribute key of span
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) (string, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+func TestSpans(t *testing.T) {
+	tp, sr := newRecorder(t)
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	defer parent.End()
+	s := New(storage.NewStorage(storagetest.OpenDB(t)), tp).WithContext(ctx)
+
+	client := &osin.DefaultClient{Id: "traced", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	data := &osin.AccessData{Client: client, AccessToken: "traced-access", RefreshToken: "traced-refresh", ExpiresIn: 3600, CreatedAt: time.Now()}
+	for _, tc := range []struct {
+		operation string
+		clientID  string
+		failed    bool
+		call      func() error
+	}{
+		{"SaveClient", client.Id, false, func() error { return s.SaveClient(client) }},
+		{"GetClient", client.Id, false, func() error { _, err := s.GetClient(client.Id); return err }},
+		{"SaveAccess", client.Id, false, func() error { return s.SaveAccess(data) }},
+		{"SaveAccess", client.Id, true, func() error { return s.SaveAccess(data) }},
+		{"LoadAccess", client.Id, false, func() error { _, err := s.LoadAccess(data.AccessToken); return err }},
+		{"LoadRefresh", client.Id, false, func() error { _, err := s.LoadRefresh(data.RefreshToken); return err }},
+		{"LoadAccess", "", false, func() error { _, err := s.LoadAccess("missing"); return err }},
+		{"RemoveAccess", "", false, func() error { return s.RemoveAccess(data.AccessToken) }},
+		{"RemoveAccess", "", false, func() error { return s.RemoveAccess(data.AccessToken) }},
+		{"PurgeExpired", "", false, func() error { _, err := s.PurgeExpired(); return err }},
+	} {
+		before := len(sr.Ended())
+		err := tc.call()
+		if tc.failed != (err != nil && !notFound(err)) {
+			t.Fatalf("%s: %v", tc.operation, err)
+		}
+		spans := sr.Ended()
+		if len(spans) != before+1 {
+			t.Fatalf("%s ended %d spans, want 1", tc.operation, len(spans)-before)
+		}
+		span := spans[len(spans)-1]
+		if span.Name() != "storage."+tc.operation || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s: span %q with parent %s", tc.operation, span.Name(), span.Parent().SpanID())
+		}
+		if op, _ := attr(span, OperationKey); op != tc.operation {
+			t.Errorf("%s: %s = %q", tc.operation, OperationKey, op)
+		}
+		if id, _ := attr(span, ClientIDKey); id != tc.clientID {
+			t.Errorf("%s: %s = %q, want %q", tc.operation, ClientIDKey, id, tc.clientID)
+		}
+
+		status, events := span.Status(), span.Events()
+		if tc.failed {
+			if status.Code != codes.Error || status.Description != err.Error() || len(events) != 1 || events[0].Name != "exception" {
+				t.Errorf("%s: status %+v, events %+v, want the error recorded", tc.operation, status, events)
+			}
+		} else if status.Code != codes.Unset || len(events) != 0 {
+			t.Errorf("%s: status %+v, events %+v, want no error", tc.operation, status, events)
+		}
+		for _, kv := range span.Attributes() {
+			if v := kv.Value.Emit(); strings.Contains(v, data.AccessToken) || strings.Contains(v, data.RefreshToken) {
+				t.Errorf("%s: attribute %s carries a token", tc.operation, kv.Key)
+			}
+		}
+	}
+}
+
+func TestRegisterCallbacks(t *testing.T) {
+	tp, sr := newRecorder(t)
+	db := storagetest.OpenDB(t)
+	RegisterCallbacks(db, tp)
+	store := storage.NewStorage(db)
+
+	// queries of a storage without a context are not traced
+	client := &osin.DefaultClient{Id: "traced", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := store.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	if spans := sr.Ended(); len(spans) != 0 {
+		t.Fatalf("ended %d spans without a context, want none", len(spans))
+	}
+
+	s := New(store, tp)
+	data := &osin.AccessData{Client: client, AccessToken: "traced-access", ExpiresIn: 3600, CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, operation := range []string{"SaveAccess", "LoadAccess"} {
+		var parent sdktrace.ReadOnlySpan
+		for _, span := range sr.Ended() {
+			if span.Name() == "storage."+operation {
+				parent = span
+			}
+		}
+		if parent == nil {
+			t.Fatalf("no %s span", operation)
+		}
+		var queries []string
+		for _, span := range sr.Ended() {
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				continue
+			}
+			queries = append(queries, span.Name())
+			if !strings.HasPrefix(span.Name(), "gorm.") || span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+				t.Errorf("%s: child span %q", operation, span.Name())
+			}
+			if statement, _ := attr(span, "db.statement"); statement == "" || strings.Contains(statement, data.AccessToken) {
+				t.Errorf("%s: %s statement %q", operation, span.Name(), statement)
+			}
+		}
+		want := map[string]string{"SaveAccess": "gorm.create oauth_access", "LoadAccess": "gorm.query oauth_access"}[operation]
+		if !contains(queries, want) {
+			t.Errorf("%s queries traced as %v, want %q among them", operation, queries, want)
+		}
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{storage.ErrNotFound, true},
+		{gorm.ErrRecordNotFound, true},
+		{gormv2.ErrRecordNotFound, true},
+		{fmt.Errorf("load: %w", gormv2.ErrRecordNotFound), true},
+		{errors.New("connection refused"), false},
+	} {
+		if got := notFound(tc.err); got != tc.want {
+			t.Errorf("notFound(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
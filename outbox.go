@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gislik/gorm"
+)
+
+// outboxEvents are the events written to the outbox by Storage configured WithOutbox
+var outboxEvents = map[string]bool{
+	EventAccessSaved:    true,
+	EventAccessRemoved:  true,
+	EventRefreshRemoved: true,
+	EventClientRemoved:  true,
+}
+
+// OutboxEvent model, a token lifecycle event waiting to be delivered by a Relay.
+// Events are written in the same transaction as the mutation they describe so none is lost
+// when the process stops before delivering them.
+type OutboxEvent struct {
+	ID               uint64     `gorm:"primary_key" json:"id"`
+	Event            string     `json:"event"`                       // One of the Event constants
+	ClientID         string     `json:"client_id"`                   // Client information
+	Subject          string     `json:"subject,omitempty"`           // End-user, when known
+	TokenFingerprint string     `json:"token_fingerprint,omitempty"` // TokenFingerprint of the token, never the token
+	CreatedAt        time.Time  `json:"created_at"`                  // Date of the event
+	DispatchedAt     *time.Time `gorm:"index" json:"-"`              // Date of delivery, nil until delivered
+	Attempts         int        `json:"-"`                           // Failed deliveries
+	LastError        string     `gorm:"type:text" json:"-"`          // Error of the last failed delivery
+}
+
+// TableName is used by `gorm`
+func (OutboxEvent) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_outbox")
+}
+
+// WithOutbox writes an OutboxEvent for SaveAccess, RemoveAccess, RemoveRefresh and RemoveClient
+// in the transaction of the mutation, see Relay
+func WithOutbox() Option {
+	return func(s *Storage) {
+		s.outbox = true
+	}
+}
+
+// Publisher delivers outbox events
+type Publisher interface {
+	Publish(ctx context.Context, e *OutboxEvent) error
+}
+
+// WebhookPublisher posts events as JSON to URL, responses other than 2xx are failures
+type WebhookPublisher struct {
+	URL    string
+	Client *http.Client // http.DefaultClient when nil
+}
+
+// Publish posts e
+func (p *WebhookPublisher) Publish(ctx context.Context, e *OutboxEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("storage: webhook %s returned %s", p.URL, resp.Status)
+	}
+	return nil
+}
+
+// WriterPublisher writes events to W as JSON lines
+type WriterPublisher struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+// NewStdoutPublisher returns a publisher writing events to the standard output
+func NewStdoutPublisher() *WriterPublisher {
+	return &WriterPublisher{W: os.Stdout}
+}
+
+// Publish writes e
+func (p *WriterPublisher) Publish(ctx context.Context, e *OutboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.NewEncoder(p.W).Encode(e)
+}
+
+// ChannelPublisher sends events to an in-process channel
+type ChannelPublisher chan OutboxEvent
+
+// Publish sends e, failing when ctx is done first
+func (p ChannelPublisher) Publish(ctx context.Context, e *OutboxEvent) error {
+	select {
+	case p <- *e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Relay delivers the events of the oauth_outbox table to a Publisher in order and marks them dispatched.
+// Delivery is at least once: an event published right before the process stops is published again,
+// consumers should deduplicate by ID. Run a single Relay per database.
+type Relay struct {
+	db        *gorm.DB
+	publisher Publisher
+
+	// BatchSize is the number of events loaded by Flush, 100 by default or when not positive
+	BatchSize int
+	// Timeout bounds each Publish call, 10 seconds by default or when not positive
+	Timeout time.Duration
+
+	mu   sync.Mutex // guards stop
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRelay returns a Relay delivering the events of db to publisher
+func NewRelay(db *gorm.DB, publisher Publisher) *Relay {
+	return &Relay{
+		db:        db,
+		publisher: publisher,
+		BatchSize: 100,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// Flush delivers the pending events until none is left and returns how many were delivered.
+// It stops at the first failed delivery, which is retried by the next Flush.
+func (r *Relay) Flush() (int, error) {
+	batch := r.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	n := 0
+	for {
+		var events []OutboxEvent
+		if err := r.db.Where("dispatched_at IS NULL").Order("id").Limit(batch).Find(&events).Error; err != nil {
+			return n, err
+		}
+		for i := range events {
+			if err := r.deliver(&events[i]); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(events) < batch {
+			return n, nil
+		}
+	}
+}
+
+// deliver publishes e and marks it dispatched, or records the failed attempt
+func (r *Relay) deliver(e *OutboxEvent) error {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := r.publisher.Publish(ctx, e); err != nil {
+		if uerr := r.db.Model(e).Updates(map[string]interface{}{"attempts": e.Attempts + 1, "last_error": err.Error()}).Error; uerr != nil {
+			return fmt.Errorf("%w (recording the failed attempt: %v)", err, uerr)
+		}
+		return err
+	}
+	return r.db.Model(e).Update("dispatched_at", time.Now()).Error
+}
+
+// Start calls Flush every interval until Stop is called, stopping the relay started before.
+// Errors are passed to onError when it is not nil. Start and Stop may be called concurrently.
+func (r *Relay) Start(interval time.Duration, onError func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := r.Flush(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+}
+
+// Stop stops the relay started by Start and waits for a running Flush to return
+func (r *Relay) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+// stopLocked stops the relay, r.mu must be held
+func (r *Relay) stopLocked() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+	r.stop = nil
+}
+
+// PurgeDispatched deletes the events delivered before t and returns how many were deleted
+func (r *Relay) PurgeDispatched(t time.Time) (int64, error) {
+	db := r.db.Where("dispatched_at < ?", t).Delete(&OutboxEvent{})
+	return db.RowsAffected, db.Error
+}
@@ -0,0 +1,190 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// publisherFunc adapts a function to storage.Publisher
+type publisherFunc func(ctx context.Context, e *storage.OutboxEvent) error
+
+func (f publisherFunc) Publish(ctx context.Context, e *storage.OutboxEvent) error {
+	return f(ctx, e)
+}
+
+// newOutboxStorage returns a storage writing to the outbox of the returned database and a saved client
+func newOutboxStorage(t *testing.T) (*storage.Storage, *gorm.DB, osin.Client) {
+	db := storagetest.OpenDB(t)
+	s := storage.NewStorage(db, storage.WithOutbox())
+	client := &osin.DefaultClient{Id: "outbox", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	return s, db, client
+}
+
+func outboxEvents(t *testing.T, db *gorm.DB) []storage.OutboxEvent {
+	var events []storage.OutboxEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestOutboxWrittenInTransaction(t *testing.T) {
+	s, db, client := newOutboxStorage(t)
+	data := &osin.AccessData{Client: client, AccessToken: "outbox-access", ExpiresIn: 3600, CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	// saving the same token again fails, its outbox event is rolled back with it
+	if err := s.SaveAccess(data); err == nil {
+		t.Fatal("SaveAccess of a duplicate token succeeded")
+	}
+	authorize := &osin.AuthorizeData{Client: client, Code: "outbox-code", ExpiresIn: 600, RedirectUri: client.RedirectUri, CreatedAt: time.Now()}
+	if err := s.SaveAuthorize(authorize); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAccess(data.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	events := outboxEvents(t, db)
+	if len(events) != 2 || events[0].Event != storage.EventAccessSaved || events[1].Event != storage.EventAccessRemoved {
+		t.Fatalf("outbox = %+v, want access.saved and access.removed", events)
+	}
+	if e := events[0]; e.ClientID != client.GetId() || e.TokenFingerprint != storage.TokenFingerprint(data.AccessToken) || e.DispatchedAt != nil {
+		t.Errorf("outbox event = %+v", e)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s, db, client := newOutboxStorage(t)
+	for _, token := range []string{"relay-1", "relay-2", "relay-3"} {
+		data := &osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 3600, CreatedAt: time.Now()}
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var published []uint64
+	fail := errors.New("unavailable")
+	relay := storage.NewRelay(db, publisherFunc(func(ctx context.Context, e *storage.OutboxEvent) error {
+		if len(published) == 1 && fail != nil {
+			return fail
+		}
+		published = append(published, e.ID)
+		return nil
+	}))
+	relay.BatchSize = 0 // clamped, Flush still ends
+
+	if n, err := relay.Flush(); err != fail || n != 1 {
+		t.Fatalf("failing Flush = %d, %v, want 1 and the failure", n, err)
+	}
+	events := outboxEvents(t, db)
+	if events[0].DispatchedAt == nil || events[1].DispatchedAt != nil || events[1].Attempts != 1 || events[1].LastError != fail.Error() {
+		t.Fatalf("outbox after failure = %+v", events)
+	}
+
+	fail = nil
+	if n, err := relay.Flush(); err != nil || n != 2 {
+		t.Fatalf("retrying Flush = %d, %v, want 2", n, err)
+	}
+	if len(published) != 3 || published[0] >= published[1] || published[1] >= published[2] {
+		t.Errorf("published %v, want the three events in order", published)
+	}
+	if n, err := relay.Flush(); err != nil || n != 0 {
+		t.Errorf("Flush without pending events = %d, %v", n, err)
+	}
+
+	if err := s.RemoveAccess("relay-1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := relay.PurgeDispatched(time.Now().Add(time.Minute)); err != nil || n != 3 {
+		t.Fatalf("PurgeDispatched = %d, %v, want 3", n, err)
+	}
+	if events := outboxEvents(t, db); len(events) != 1 || events[0].Event != storage.EventAccessRemoved {
+		t.Errorf("outbox after PurgeDispatched = %+v, want the pending event kept", events)
+	}
+}
+
+func TestRelayStartStop(t *testing.T) {
+	s, db, client := newOutboxStorage(t)
+	events := make(storage.ChannelPublisher, 1)
+	relay := storage.NewRelay(db, events)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay.Start(time.Millisecond, nil)
+			relay.Stop()
+		}()
+	}
+	wg.Wait()
+
+	relay.Start(time.Millisecond, func(err error) { t.Error(err) })
+	defer relay.Stop()
+	data := &osin.AccessData{Client: client, AccessToken: "started", ExpiresIn: 3600, CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.TokenFingerprint != storage.TokenFingerprint(data.AccessToken) {
+			t.Errorf("relayed %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the started relay delivered nothing")
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	e := &storage.OutboxEvent{ID: 7, Event: storage.EventAccessRemoved, ClientID: "client", CreatedAt: time.Now()}
+
+	var buf bytes.Buffer
+	if err := (&storage.WriterPublisher{W: &buf}).Publish(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	var written storage.OutboxEvent
+	if err := json.Unmarshal(buf.Bytes(), &written); err != nil || written.ID != 7 || written.Event != e.Event {
+		t.Errorf("WriterPublisher wrote %s, %v", buf.String(), err)
+	}
+
+	status := http.StatusNoContent
+	var received storage.OutboxEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook received %v, Content-Type %q", err, r.Header.Get("Content-Type"))
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	webhook := &storage.WebhookPublisher{URL: server.URL}
+	if err := webhook.Publish(context.Background(), e); err != nil || received.ID != 7 {
+		t.Errorf("WebhookPublisher = %v, received %+v", err, received)
+	}
+	status = http.StatusInternalServerError
+	if err := webhook.Publish(context.Background(), e); err == nil {
+		t.Error("WebhookPublisher succeeded on a 500 response")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := make(storage.ChannelPublisher).Publish(ctx, e); err != context.Canceled {
+		t.Errorf("ChannelPublisher with a done context = %v, want context.Canceled", err)
+	}
+}
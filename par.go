@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/openshift/osin"
+)
+
+// RequestURIPrefix prefixes the request_uri of pushed authorization requests
+const RequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// ErrExpiredRequest is returned when a pushed authorization request expired
+var ErrExpiredRequest = errors.New("storage: pushed request expired")
+
+// PushedRequest model, an authorization request pushed by a client as described in rfc9126
+type PushedRequest struct {
+	RequestURI string    `gorm:"primary_key"` // request_uri returned to the client
+	ClientID   string    // Client information
+	Parameters string    `gorm:"type:text"` // Authorization request parameters, form encoded
+	ExpiresIn  int32     // Request expiration in seconds
+	CreatedAt  time.Time // Date created
+}
+
+// TableName is used by `gorm`
+func (PushedRequest) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_pushed_request")
+}
+
+// IsExpired reports whether the pushed request expired
+func (p *PushedRequest) IsExpired() bool {
+	return time.Now().After(p.CreatedAt.Add(time.Duration(p.ExpiresIn) * time.Second))
+}
+
+// parameters decodes the parameters of the pushed request, ErrExpiredRequest when it expired
+func (p *PushedRequest) parameters() (url.Values, error) {
+	if p.IsExpired() {
+		return nil, ErrExpiredRequest
+	}
+	return url.ParseQuery(p.Parameters)
+}
+
+// SavePushedRequest saves a pushed authorization request
+func (s *Storage) SavePushedRequest(p *PushedRequest) error {
+	return s.db.Create(p).Error
+}
+
+// LoadPushedRequest returns the parameters of the pushed request with requestURI made by clientID
+// without consuming it
+func (s *Storage) LoadPushedRequest(requestURI, clientID string) (url.Values, error) {
+	var p PushedRequest
+	if err := s.db.Where("request_uri = ? AND client_id = ?", requestURI, clientID).First(&p).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return p.parameters()
+}
+
+// ConsumePushedRequest removes the pushed request with requestURI made by clientID and returns its parameters.
+// A request can be consumed once, ErrNotFound is returned afterwards.
+func (s *Storage) ConsumePushedRequest(requestURI, clientID string) (url.Values, error) {
+	tx := s.db.Begin()
+	var p PushedRequest
+	if err := tx.Where("request_uri = ? AND client_id = ?", requestURI, clientID).First(&p).Error; err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if err := affected(tx.Where("request_uri = ?", requestURI).Delete(&PushedRequest{})); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return p.parameters()
+}
+
+// PushedAuthorizationHandler serves the pushed authorization request endpoint of rfc9126.
+// The client is authenticated like at the token endpoint and the request is stored
+// for expiration seconds, 60 when zero.
+func PushedAuthorizationHandler(s *Storage, expiration int32) http.Handler {
+	if expiration == 0 {
+		expiration = 60
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, osin.E_INVALID_REQUEST)
+			return
+		}
+		client, ok := authenticateClient(s, r)
+		if !ok {
+			writeOAuthError(w, http.StatusUnauthorized, osin.E_INVALID_CLIENT)
+			return
+		}
+		params := url.Values{}
+		for k, v := range r.PostForm {
+			params[k] = v
+		}
+		params.Del("client_secret")
+		if params.Get("request_uri") != "" || params.Get("response_type") == "" {
+			writeOAuthError(w, http.StatusBadRequest, osin.E_INVALID_REQUEST)
+			return
+		}
+		if id := params.Get("client_id"); id != "" && id != client.GetId() {
+			writeOAuthError(w, http.StatusBadRequest, osin.E_INVALID_REQUEST)
+			return
+		}
+		params.Set("client_id", client.GetId())
+
+		token, err := NewToken(PushedRequestPrefix)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, osin.E_SERVER_ERROR)
+			return
+		}
+		p := &PushedRequest{
+			RequestURI: RequestURIPrefix + token,
+			ClientID:   client.GetId(),
+			Parameters: params.Encode(),
+			ExpiresIn:  expiration,
+			CreatedAt:  time.Now(),
+		}
+		if err := s.SavePushedRequest(p); err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, osin.E_SERVER_ERROR)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"request_uri": p.RequestURI,
+			"expires_in":  p.ExpiresIn,
+		})
+	})
+}
+
+// ResolvePushedRequest replaces the parameters of an authorization request referencing
+// a pushed request by request_uri with the pushed ones and reports whether it did.
+// Call it before osin's HandleAuthorizeRequest. The URL is left as is, so login and consent pages
+// posting back to it resolve the pushed request again. Fields they post are kept, the pushed
+// parameters take precedence. Call ConsumeResolvedRequest once the authorization is decided.
+func ResolvePushedRequest(s *Storage, r *http.Request) (bool, error) {
+	if err := r.ParseForm(); err != nil {
+		return false, err
+	}
+	requestURI := r.Form.Get("request_uri")
+	if !strings.HasPrefix(requestURI, RequestURIPrefix) {
+		return false, nil
+	}
+	params, err := s.LoadPushedRequest(requestURI, r.Form.Get("client_id"))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range r.PostForm {
+		if _, ok := params[k]; !ok {
+			params[k] = v
+		}
+	}
+	params.Set("request_uri", requestURI)
+	r.Form = params
+	return true, nil
+}
+
+// ConsumeResolvedRequest consumes the pushed request resolved for r by ResolvePushedRequest, if any,
+// so its request_uri cannot be used again. Call it before osin's FinishAuthorizeRequest,
+// ErrNotFound is returned when the request was already used.
+func ConsumeResolvedRequest(s *Storage, r *http.Request) error {
+	requestURI := r.Form.Get("request_uri")
+	if !strings.HasPrefix(requestURI, RequestURIPrefix) {
+		return nil
+	}
+	_, err := s.ConsumePushedRequest(requestURI, r.Form.Get("client_id"))
+	return err
+}
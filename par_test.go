@@ -0,0 +1,67 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestPushedRequestRoundTrip(t *testing.T) {
+	s := storage.NewStorage(storagetest.OpenDB(t))
+	client := &osin.DefaultClient{Id: "par-client", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+
+	push := url.Values{"response_type": {"code"}, "scope": {"openid"}, "redirect_uri": {client.RedirectUri}}
+	req := httptest.NewRequest("POST", "/par", strings.NewReader(push.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.Id, client.Secret)
+	w := httptest.NewRecorder()
+	storage.PushedAuthorizationHandler(s, 0).ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("push status = %d: %s", w.Code, w.Body)
+	}
+	var out struct {
+		RequestURI string `json:"request_uri"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	target := "/authorize?" + url.Values{"request_uri": {out.RequestURI}, "client_id": {client.Id}}.Encode()
+
+	// the authorization request and the login page posting back to it both resolve the pushed request
+	r := httptest.NewRequest("GET", target, nil)
+	if ok, err := storage.ResolvePushedRequest(s, r); !ok || err != nil {
+		t.Fatalf("ResolvePushedRequest = %v, %v", ok, err)
+	}
+	login := url.Values{"login": {"test"}, "scope": {"admin"}}
+	r = httptest.NewRequest("POST", target, strings.NewReader(login.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ok, err := storage.ResolvePushedRequest(s, r); !ok || err != nil {
+		t.Fatalf("ResolvePushedRequest after login = %v, %v", ok, err)
+	}
+	if r.FormValue("scope") != "openid" || r.FormValue("login") != "test" || r.FormValue("response_type") != "code" {
+		t.Errorf("Form = %v, want the pushed parameters and the login field", r.Form)
+	}
+	if r.URL.Query().Get("request_uri") != out.RequestURI {
+		t.Errorf("URL = %s, want the request_uri kept", r.URL)
+	}
+
+	if err := storage.ConsumeResolvedRequest(s, r); err != nil {
+		t.Fatalf("ConsumeResolvedRequest: %v", err)
+	}
+	if err := storage.ConsumeResolvedRequest(s, r); err != storage.ErrNotFound {
+		t.Errorf("second ConsumeResolvedRequest = %v, want ErrNotFound", err)
+	}
+	if _, err := storage.ResolvePushedRequest(s, httptest.NewRequest("GET", target, nil)); err != storage.ErrNotFound {
+		t.Errorf("ResolvePushedRequest after consumption = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Package promstorage instruments an osin.Storage with Prometheus metrics.
+//
+// Every osin.Storage method is counted by outcome and timed. When the wrapped storage
+// counts its live tokens, like storage.Storage, a gauge per client is reported, and
+// PurgeExpired calls are counted. Live tokens are counted again once LiveTokensTTL passed,
+// not on every scrape.
+package promstorage
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+	"github.com/prometheus/client_golang/prometheus"
+	gormv2 "gorm.io/gorm"
+)
+
+// Outcomes of storage calls
+const (
+	OK       = "ok"
+	NotFound = "not_found"
+	Expired  = "expired"
+	Error    = "error"
+)
+
+// DefaultLiveTokensTTL is how long live token counts are reused when LiveTokensTTL is zero
+const DefaultLiveTokensTTL = time.Minute
+
+// LiveTokenCounter is implemented by storages able to count their unexpired access tokens per client
+type LiveTokenCounter interface {
+	LiveTokens() (map[string]int64, error)
+}
+
+// Purger is implemented by storages deleting their expired data
+type Purger interface {
+	PurgeExpired() (int64, error)
+}
+
+type metrics struct {
+	calls   *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	purged  prometheus.Counter
+	live    *prometheus.Desc
+	scrapes *prometheus.CounterVec
+
+	// the last live token counts, reused by scrapes until they are older than LiveTokensTTL
+	countMu   sync.Mutex
+	counts    map[string]int64
+	countedAt time.Time
+}
+
+// Storage wraps an osin.Storage and implements prometheus.Collector
+type Storage struct {
+	osin.Storage
+	*metrics
+
+	// RefreshExpiration is the lifetime of refresh tokens, LoadRefresh counts older access data as expired.
+	// Refresh tokens are not counted as expired when zero.
+	RefreshExpiration time.Duration
+
+	// LiveTokensTTL is how long the live token counts are reused by scrapes, DefaultLiveTokensTTL when zero.
+	// Counting scans the access table. Live tokens are counted on every scrape when negative.
+	LiveTokensTTL time.Duration
+}
+
+// New returns s instrumented, register it with prometheus.MustRegister
+func New(s osin.Storage) *Storage {
+	return &Storage{
+		Storage: s,
+		metrics: &metrics{
+			calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "osin_storage_calls_total",
+				Help: "Storage calls by method and outcome.",
+			}, []string{"method", "outcome"}),
+			latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "osin_storage_call_duration_seconds",
+				Help:    "Latency of storage calls by method.",
+				Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+			}, []string{"method"}),
+			purged: prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "osin_storage_purged_total",
+				Help: "Expired authorize and access data deleted by PurgeExpired.",
+			}),
+			live: prometheus.NewDesc(
+				"osin_storage_live_tokens",
+				"Unexpired access tokens by client.",
+				[]string{"client_id"}, nil,
+			),
+			scrapes: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "osin_storage_live_tokens_scrapes_total",
+				Help: "Live token counts by outcome.",
+			}, []string{"outcome"}),
+		},
+	}
+}
+
+// Describe implements prometheus.Collector
+func (s *Storage) Describe(ch chan<- *prometheus.Desc) {
+	s.calls.Describe(ch)
+	s.latency.Describe(ch)
+	s.purged.Describe(ch)
+	s.scrapes.Describe(ch)
+	ch <- s.live
+}
+
+// Collect implements prometheus.Collector.
+// Live tokens are counted when the last counts are older than LiveTokensTTL.
+func (s *Storage) Collect(ch chan<- prometheus.Metric) {
+	if counter, ok := s.Storage.(LiveTokenCounter); ok {
+		if live, err := s.liveTokens(counter); err == nil {
+			for client, n := range live {
+				ch <- prometheus.MustNewConstMetric(s.live, prometheus.GaugeValue, float64(n), client)
+			}
+		}
+	}
+	s.calls.Collect(ch)
+	s.latency.Collect(ch)
+	s.purged.Collect(ch)
+	s.scrapes.Collect(ch)
+}
+
+// liveTokens returns the live token counts of counter, counting again when the last counts are older
+// than LiveTokensTTL. Only the scrapes counting again are reported by the scrapes counter.
+func (s *Storage) liveTokens(counter LiveTokenCounter) (map[string]int64, error) {
+	ttl := s.LiveTokensTTL
+	if ttl == 0 {
+		ttl = DefaultLiveTokensTTL
+	}
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	if s.counts != nil && time.Since(s.countedAt) < ttl {
+		return s.counts, nil
+	}
+	live, err := counter.LiveTokens()
+	if err != nil {
+		s.scrapes.WithLabelValues(Error).Inc()
+		return nil, err
+	}
+	s.scrapes.WithLabelValues(OK).Inc()
+	if live == nil {
+		live = make(map[string]int64)
+	}
+	s.counts, s.countedAt = live, time.Now()
+	return live, nil
+}
+
+// observe records a call of method started at start which returned err
+func (s *Storage) observe(method string, start time.Time, err error, expired bool) {
+	s.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	s.calls.WithLabelValues(method, outcome(err, expired)).Inc()
+}
+
+// notFound are the errors of the storages counted as NotFound: storage.ErrNotFound and the errors
+// returned for missing rows by gorm v1, gorm v2 (gormv2.Storage) and database/sql
+var notFound = []error{
+	storage.ErrNotFound, storage.ErrMalformedToken, storage.ErrInvalidJWT,
+	gorm.ErrRecordNotFound, gormv2.ErrRecordNotFound, sql.ErrNoRows,
+}
+
+// outcome classifies the result of a call
+func outcome(err error, expired bool) string {
+	if err == nil {
+		if expired {
+			return Expired
+		}
+		return OK
+	}
+	for _, target := range notFound {
+		if errors.Is(err, target) {
+			return NotFound
+		}
+	}
+	return Error
+}
+
+// With returns inner instrumented with the metrics of s,
+// e.g. a storage.Storage returned by WithContext for a request
+func (s *Storage) With(inner osin.Storage) *Storage {
+	c := *s
+	c.Storage = inner
+	return &c
+}
+
+// Clone clones the wrapped storage, the clone shares the metrics
+func (s *Storage) Clone() osin.Storage {
+	c := *s
+	c.Storage = s.Storage.Clone()
+	return &c
+}
+
+// refreshExpired reports whether the refresh token of data outlived RefreshExpiration
+func (s *Storage) refreshExpired(data *osin.AccessData) bool {
+	return data != nil && s.RefreshExpiration > 0 && time.Now().After(data.CreatedAt.Add(s.RefreshExpiration))
+}
+
+// GetClient loads the client by id
+func (s *Storage) GetClient(id string) (c osin.Client, err error) {
+	defer func(start time.Time) { s.observe("GetClient", start, err, false) }(time.Now())
+	return s.Storage.GetClient(id)
+}
+
+// SaveAuthorize saves authorize data
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	defer func(start time.Time) { s.observe("SaveAuthorize", start, err, false) }(time.Now())
+	return s.Storage.SaveAuthorize(data)
+}
+
+// LoadAuthorize looks up authorize data by code
+func (s *Storage) LoadAuthorize(code string) (data *osin.AuthorizeData, err error) {
+	defer func(start time.Time) { s.observe("LoadAuthorize", start, err, data != nil && data.IsExpired()) }(time.Now())
+	return s.Storage.LoadAuthorize(code)
+}
+
+// RemoveAuthorize revokes or deletes the authorization code
+func (s *Storage) RemoveAuthorize(code string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveAuthorize", start, err, false) }(time.Now())
+	return s.Storage.RemoveAuthorize(code)
+}
+
+// SaveAccess writes access data
+func (s *Storage) SaveAccess(data *osin.AccessData) (err error) {
+	defer func(start time.Time) { s.observe("SaveAccess", start, err, false) }(time.Now())
+	return s.Storage.SaveAccess(data)
+}
+
+// LoadAccess retrieves access data by token
+func (s *Storage) LoadAccess(token string) (data *osin.AccessData, err error) {
+	defer func(start time.Time) { s.observe("LoadAccess", start, err, data != nil && data.IsExpired()) }(time.Now())
+	return s.Storage.LoadAccess(token)
+}
+
+// RemoveAccess revokes or deletes access data
+func (s *Storage) RemoveAccess(token string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveAccess", start, err, false) }(time.Now())
+	return s.Storage.RemoveAccess(token)
+}
+
+// LoadRefresh retrieves refresh access data
+func (s *Storage) LoadRefresh(token string) (data *osin.AccessData, err error) {
+	defer func(start time.Time) { s.observe("LoadRefresh", start, err, s.refreshExpired(data)) }(time.Now())
+	return s.Storage.LoadRefresh(token)
+}
+
+// RemoveRefresh revokes or deletes refresh access data
+func (s *Storage) RemoveRefresh(token string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveRefresh", start, err, false) }(time.Now())
+	return s.Storage.RemoveRefresh(token)
+}
+
+// PurgeExpired purges the wrapped storage when it is a Purger and counts the deleted data
+func (s *Storage) PurgeExpired() (n int64, err error) {
+	defer func(start time.Time) { s.observe("PurgeExpired", start, err, false) }(time.Now())
+	purger, ok := s.Storage.(Purger)
+	if !ok {
+		return 0, nil
+	}
+	n, err = purger.PurgeExpired()
+	s.purged.Add(float64(n))
+	return n, err
+}
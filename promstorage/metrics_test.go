@@ -0,0 +1,136 @@
+package promstorage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gormv2 "gorm.io/gorm"
+)
+
+// newMetered returns a Storage instrumenting a storage.Storage and a saved client
+func newMetered(t *testing.T) (*Storage, *storage.Storage, osin.Client) {
+	inner := storage.NewStorage(storagetest.OpenDB(t))
+	client := &osin.DefaultClient{Id: "metered", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := inner.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	return New(inner), inner, client
+}
+
+func TestCalls(t *testing.T) {
+	s, _, client := newMetered(t)
+	s.RefreshExpiration = time.Minute
+	live := &osin.AccessData{Client: client, AccessToken: "live", RefreshToken: "live-refresh", ExpiresIn: 3600, CreatedAt: time.Now()}
+	old := &osin.AccessData{Client: client, AccessToken: "old", RefreshToken: "old-refresh", ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)}
+	for _, data := range []*osin.AccessData{live, old} {
+		if err := s.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.LoadAccess(live.AccessToken)
+	s.LoadAccess(old.AccessToken)
+	s.LoadAccess("missing")
+	s.LoadRefresh(live.RefreshToken)
+	s.LoadRefresh(old.RefreshToken)
+	s.RemoveAccess("missing")
+	// a storage returned by With counts into the same metrics
+	s.With(s.Storage).LoadAccess("missing")
+
+	for _, tc := range []struct {
+		method, outcome string
+		want            float64
+	}{
+		{"SaveAccess", OK, 2},
+		{"LoadAccess", OK, 1},
+		{"LoadAccess", Expired, 1},
+		{"LoadAccess", NotFound, 2},
+		{"LoadRefresh", OK, 1},
+		{"LoadRefresh", Expired, 1},
+		{"RemoveAccess", NotFound, 1},
+	} {
+		if got := testutil.ToFloat64(s.calls.WithLabelValues(tc.method, tc.outcome)); got != tc.want {
+			t.Errorf("%s %s calls = %v, want %v", tc.method, tc.outcome, got, tc.want)
+		}
+	}
+	if n := testutil.CollectAndCount(s.latency); n != 4 {
+		t.Errorf("latency histograms = %d, want SaveAccess, LoadAccess, LoadRefresh and RemoveAccess", n)
+	}
+
+	if n, err := s.PurgeExpired(); err != nil || n != 1 {
+		t.Fatalf("PurgeExpired = %d, %v, want 1", n, err)
+	}
+	if got := testutil.ToFloat64(s.purged); got != 1 {
+		t.Errorf("purged = %v, want 1", got)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		expired bool
+		want    string
+	}{
+		{nil, false, OK},
+		{nil, true, Expired},
+		{storage.ErrNotFound, false, NotFound},
+		{storage.ErrMalformedToken, false, NotFound},
+		{storage.ErrInvalidJWT, false, NotFound},
+		{gorm.ErrRecordNotFound, false, NotFound},
+		{gormv2.ErrRecordNotFound, false, NotFound},
+		{sql.ErrNoRows, false, NotFound},
+		{fmt.Errorf("load: %w", gormv2.ErrRecordNotFound), false, NotFound},
+		{errors.New("connection refused"), false, Error},
+	} {
+		if got := outcome(tc.err, tc.expired); got != tc.want {
+			t.Errorf("outcome(%v, %v) = %s, want %s", tc.err, tc.expired, got, tc.want)
+		}
+	}
+}
+
+func TestLiveTokens(t *testing.T) {
+	s, inner, client := newMetered(t)
+	save := func(token string) {
+		data := &osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 3600, CreatedAt: time.Now()}
+		if err := inner.SaveAccess(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gauge := func(n int) string {
+		return fmt.Sprintf(`
+# HELP osin_storage_live_tokens Unexpired access tokens by client.
+# TYPE osin_storage_live_tokens gauge
+osin_storage_live_tokens{client_id="metered"} %d
+`, n)
+	}
+
+	save("first")
+	if err := testutil.CollectAndCompare(s, strings.NewReader(gauge(1)), "osin_storage_live_tokens"); err != nil {
+		t.Error(err)
+	}
+	// counted once, later scrapes reuse the counts until LiveTokensTTL passed
+	save("second")
+	if err := testutil.CollectAndCompare(s, strings.NewReader(gauge(1)), "osin_storage_live_tokens"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(s.scrapes.WithLabelValues(OK)); got != 1 {
+		t.Errorf("counted %v times, want once", got)
+	}
+
+	s.LiveTokensTTL = -1
+	if err := testutil.CollectAndCompare(s, strings.NewReader(gauge(2)), "osin_storage_live_tokens"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(s.scrapes.WithLabelValues(OK)); got < 2 {
+		t.Errorf("counted %v times with a negative LiveTokensTTL, want again", got)
+	}
+}
@@ -0,0 +1,254 @@
+// Package redisstorage keeps authorize and access data in Redis while clients stay in the gorm backed storage.
+//
+// Any server speaking the Redis protocol works, including an in-process
+// github.com/alicebob/miniredis instance in tests.
+package redisstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gomodule/redigo/redis"
+	"github.com/openshift/osin"
+)
+
+const (
+	authorizeKey = "oauth_authorize:"
+	accessKey    = "oauth_access:"
+	refreshKey   = "oauth_refresh:"
+)
+
+// Storage stores clients through a storage.Storage and
+// authorize and access data in Redis with TTLs derived from ExpiresIn.
+//
+// Access data is stored twice: under its access token until the access token expires
+// and, when it has a refresh token, under its refresh token for RefreshExpiration.
+type Storage struct {
+	clients *storage.Storage
+
+	pool   *redis.Pool
+	prefix string
+
+	// RefreshExpiration is how long access data with a refresh token can be loaded by LoadRefresh.
+	// Below a second the refresh token expires with the access token.
+	RefreshExpiration time.Duration
+}
+
+// New returns a Storage keeping clients in s and tokens in the Redis pool.
+// Keys are prefixed with prefix.
+func New(s *storage.Storage, pool *redis.Pool, prefix string) *Storage {
+	return &Storage{
+		clients:           s,
+		pool:              pool,
+		prefix:            prefix,
+		RefreshExpiration: 30 * 24 * time.Hour,
+	}
+}
+
+// Clone the storage if needed.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds
+func (s *Storage) Close() {
+}
+
+// GetClient loads the client by id (client_id)
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	return s.clients.GetClient(id)
+}
+
+// SaveClient saves client
+func (s *Storage) SaveClient(c osin.Client) error {
+	return s.clients.SaveClient(c)
+}
+
+// RemoveClient removes the client with matching id
+func (s *Storage) RemoveClient(id string) error {
+	return s.clients.RemoveClient(id)
+}
+
+// SaveAuthorize saves authorize data until it expires.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	authorize, err := storage.AuthorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(&authorize)
+	if err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", s.prefix+authorizeKey+authorize.Code, v, "EX", seconds(data.ExpireAt()), "NX")
+	if err == nil && reply == nil {
+		err = errors.New("redisstorage: authorize code already exists")
+	}
+	return err
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var authorize storage.Authorize
+	if err := s.get(conn, authorizeKey+code, &authorize); err != nil {
+		return nil, err
+	}
+	client, err := s.GetClient(authorize.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return authorize.ToOsin(client), nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.del(conn, authorizeKey+code)
+}
+
+// SaveAccess writes AccessData until it expires and, when it has a refresh token,
+// under the refresh token for RefreshExpiration.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	access, err := storage.AccessFromOsin(data)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(&access)
+	if err != nil {
+		return err
+	}
+	ttl := seconds(data.ExpireAt())
+	refreshTTL := ttl
+	if s.RefreshExpiration >= time.Second {
+		refreshTTL = int64(s.RefreshExpiration / time.Second)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("SET", s.prefix+accessKey+access.AccessToken, v, "EX", ttl); err != nil {
+		return err
+	}
+	if access.RefreshToken != "" {
+		if err := conn.Send("SET", s.prefix+refreshKey+access.RefreshToken, v, "EX", refreshTTL); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// LoadAccess retrieves access data by token.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.loadAccess(conn, accessKey+code)
+}
+
+// RemoveAccess revokes or deletes an AccessData together with its refresh token.
+func (s *Storage) RemoveAccess(code string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.removeAccess(conn, accessKey+code)
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.loadAccess(conn, refreshKey+code)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData together with its access token.
+func (s *Storage) RemoveRefresh(code string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.removeAccess(conn, refreshKey+code)
+}
+
+// loadAccess loads the access data stored under key, an access or a refresh key
+func (s *Storage) loadAccess(conn redis.Conn, key string) (*osin.AccessData, error) {
+	var access storage.Access
+	if err := s.get(conn, key, &access); err != nil {
+		return nil, err
+	}
+	client, err := s.GetClient(access.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	oa := access.ToOsin(client)
+	if access.Authorize != "" {
+		var authorize storage.Authorize
+		if err := s.get(conn, authorizeKey+access.Authorize, &authorize); err == nil && authorize.ClientID == access.ClientID {
+			oa.AuthorizeData = authorize.ToOsin(client)
+		}
+	}
+	return oa, nil
+}
+
+// removeAccess deletes the access data stored under key, an access or a refresh key,
+// under both its access and refresh token
+func (s *Storage) removeAccess(conn redis.Conn, key string) error {
+	var access storage.Access
+	if err := s.get(conn, key, &access); err == gorm.ErrRecordNotFound {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	keys := []interface{}{s.prefix + accessKey + access.AccessToken}
+	if access.RefreshToken != "" {
+		keys = append(keys, s.prefix+refreshKey+access.RefreshToken)
+	}
+	_, err := conn.Do("DEL", keys...)
+	return err
+}
+
+// get decodes the JSON value of key into v.
+// A missing key is reported as gorm.ErrRecordNotFound like Storage does.
+func (s *Storage) get(conn redis.Conn, key string, v interface{}) error {
+	b, err := redis.Bytes(conn.Do("GET", s.prefix+key))
+	if err == redis.ErrNil {
+		return gorm.ErrRecordNotFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// del removes key, returning storage.ErrNotFound when it did not exist
+func (s *Storage) del(conn redis.Conn, key string) error {
+	n, err := redis.Int(conn.Do("DEL", s.prefix+key))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// seconds returns the TTL in seconds until t, Redis rejects non positive expirations
+func seconds(t time.Time) int64 {
+	if ttl := int64(time.Until(t) / time.Second); ttl > 0 {
+		return ttl
+	}
+	return 1
+}
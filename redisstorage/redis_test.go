@@ -0,0 +1,61 @@
+package redisstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/gomodule/redigo/redis"
+	"github.com/openshift/osin"
+)
+
+// newStorage returns a Storage on a miniredis server and an in-memory SQLite database
+func newStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return redis.Dial("tcp", mr.Addr())
+	}}
+	t.Cleanup(func() { pool.Close() })
+	return New(storage.NewStorage(storagetest.OpenDB(t)), pool, "test:"), mr
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		s, _ := newStorage(t)
+		return s
+	})
+}
+
+func TestRefreshOutlivesAccess(t *testing.T) {
+	s, mr := newStorage(t)
+	s.RefreshExpiration = time.Hour
+	client := &osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	data := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresIn:    60,
+		CreatedAt:    time.Now(),
+	}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, err := s.LoadAccess(data.AccessToken); err == nil {
+		t.Error("LoadAccess succeeded after the access token expired")
+	}
+	if _, err := s.LoadRefresh(data.RefreshToken); err != nil {
+		t.Errorf("LoadRefresh after the access token expired: %v", err)
+	}
+
+	mr.FastForward(time.Hour)
+	if _, err := s.LoadRefresh(data.RefreshToken); err == nil {
+		t.Error("LoadRefresh succeeded after RefreshExpiration")
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
+)
+
+// ErrInvalidScope is returned for requested scopes that are unknown or not allowed to the client
+var ErrInvalidScope = errors.New("storage: invalid scope")
+
+// Scope model, a scope known to the server
+type Scope struct {
+	Name        string `gorm:"primary_key"` // Scope as requested, e.g. profile
+	Description string // Shown to the end-user on the consent screen
+	Default     bool   // Granted when a request has no scope
+}
+
+// TableName is used by `gorm`
+func (Scope) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_scope")
+}
+
+// ClientScope model, a scope a client is allowed to request
+type ClientScope struct {
+	ClientID string `gorm:"primary_key"` // Client information
+	Scope    string `gorm:"primary_key"` // Scope name
+}
+
+// TableName is used by `gorm`
+func (ClientScope) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_client_scope")
+}
+
+// ScopeRegistry manages the scopes of the oauth_scope table and the scopes clients may request.
+// Clients may only request the scopes they are allowed, none unless OpenScopes is set.
+type ScopeRegistry struct {
+	db   *gorm.DB
+	open bool
+}
+
+// ScopeOption configures a ScopeRegistry
+type ScopeOption func(*ScopeRegistry)
+
+// OpenScopes lets clients without allowed scopes request every registered scope
+func OpenScopes() ScopeOption {
+	return func(sr *ScopeRegistry) {
+		sr.open = true
+	}
+}
+
+// NewScopeRegistry returns a ScopeRegistry on db
+func NewScopeRegistry(db *gorm.DB, opts ...ScopeOption) *ScopeRegistry {
+	sr := &ScopeRegistry{db: db}
+	for _, opt := range opts {
+		opt(sr)
+	}
+	return sr
+}
+
+// SaveScope creates or updates a scope
+func (sr *ScopeRegistry) SaveScope(scope *Scope) error {
+	return sr.db.Save(scope).Error
+}
+
+// RemoveScope removes a scope and withdraws it from the clients allowed to request it
+func (sr *ScopeRegistry) RemoveScope(name string) error {
+	tx := sr.db.Begin()
+	if err := tx.Where("scope = ?", name).Delete(&ClientScope{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := affected(tx.Where("name = ?", name).Delete(&Scope{})); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Scopes returns the registered scopes
+func (sr *ScopeRegistry) Scopes() ([]Scope, error) {
+	var scopes []Scope
+	if err := sr.db.Order("name").Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+// Allow lets clientID request scopes, which must be registered
+func (sr *ScopeRegistry) Allow(clientID string, scopes ...string) error {
+	tx := sr.db.Begin()
+	for _, name := range scopes {
+		var count int
+		if err := tx.Model(&Scope{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if count == 0 {
+			tx.Rollback()
+			return ErrInvalidScope
+		}
+		if err := tx.Save(&ClientScope{ClientID: clientID, Scope: name}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Disallow withdraws scopes from clientID
+func (sr *ScopeRegistry) Disallow(clientID string, scopes ...string) error {
+	return sr.db.Where("client_id = ? AND scope IN (?)", clientID, scopes).Delete(&ClientScope{}).Error
+}
+
+// Allowed returns the scopes clientID was allowed with Allow. It does not account for OpenScopes:
+// a client without allowed scopes may request every registered scope with OpenScopes and none without.
+func (sr *ScopeRegistry) Allowed(clientID string) ([]string, error) {
+	var scopes []string
+	if err := sr.db.Model(&ClientScope{}).Where("client_id = ?", clientID).Order("scope").Pluck("scope", &scopes).Error; err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+// Validate returns the scope granted to clientID for the requested space delimited scope.
+// Unknown scopes are rejected with ErrInvalidScope, scopes the client is not allowed to request
+// are dropped and the default scopes the client is allowed are granted when scope is empty.
+// The granted scope is normalized, sorted without duplicates.
+// Call it on osin authorize and access requests before finishing them, e.g.
+//
+//	if ar.Scope, err = scopes.Validate(ar.Client.GetId(), ar.Scope); err != nil {
+//		resp.SetError(osin.E_INVALID_SCOPE, "")
+//	}
+func (sr *ScopeRegistry) Validate(clientID, scope string) (string, error) {
+	var registered []Scope
+	if err := sr.db.Find(&registered).Error; err != nil {
+		return "", err
+	}
+	allowed, err := sr.Allowed(clientID)
+	if err != nil {
+		return "", err
+	}
+	known := make(map[string]Scope, len(registered))
+	for _, s := range registered {
+		known[s.Name] = s
+	}
+	permitted := func(name string) bool {
+		if len(allowed) == 0 {
+			return sr.open
+		}
+		for _, a := range allowed {
+			if a == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		for _, s := range registered {
+			if s.Default && permitted(s.Name) {
+				requested = append(requested, s.Name)
+			}
+		}
+		return model.NormalizeScope(strings.Join(requested, " ")), nil
+	}
+	var granted []string
+	for _, name := range requested {
+		if _, ok := known[name]; !ok {
+			return "", ErrInvalidScope
+		}
+		if permitted(name) {
+			granted = append(granted, name)
+		}
+	}
+	if len(granted) == 0 {
+		return "", ErrInvalidScope
+	}
+	return model.NormalizeScope(strings.Join(granted, " ")), nil
+}
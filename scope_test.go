@@ -0,0 +1,90 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+)
+
+func TestScopeRegistryDefaultDeny(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	scopes := storage.NewScopeRegistry(db)
+	for _, s := range []storage.Scope{{Name: "profile", Default: true}, {Name: "admin"}} {
+		if err := scopes.SaveScope(&s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := scopes.Allow("allowed", "profile"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := scopes.Validate("allowed", "profile admin"); err != nil || got != "profile" {
+		t.Errorf("Validate allowed = %q, %v, want profile", got, err)
+	}
+	if got, err := scopes.Validate("unlisted", "profile"); err != storage.ErrInvalidScope {
+		t.Errorf("Validate unlisted = %q, %v, want ErrInvalidScope", got, err)
+	}
+	if got, err := scopes.Validate("unlisted", ""); err != nil || got != "" {
+		t.Errorf("Validate unlisted defaults = %q, %v, want no scope", got, err)
+	}
+
+	open := storage.NewScopeRegistry(db, storage.OpenScopes())
+	if got, err := open.Validate("unlisted", "profile admin"); err != nil || got != "admin profile" {
+		t.Errorf("Validate unlisted with OpenScopes = %q, %v, want admin profile", got, err)
+	}
+	if got, err := open.Validate("allowed", "admin"); err != storage.ErrInvalidScope {
+		t.Errorf("Validate allowed with OpenScopes = %q, %v, want ErrInvalidScope", got, err)
+	}
+}
+
+func TestScopeRegistryValidate(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	for _, open := range []bool{false, true} {
+		var opts []storage.ScopeOption
+		if open {
+			opts = append(opts, storage.OpenScopes())
+		}
+		scopes := storage.NewScopeRegistry(db, opts...)
+		for _, s := range []storage.Scope{{Name: "read", Default: true}, {Name: "write"}, {Name: "profile", Default: true}, {Name: "admin"}} {
+			if err := scopes.SaveScope(&s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := scopes.Allow("client", "write", "read", "profile"); err != nil {
+			t.Fatal(err)
+		}
+		if allowed, err := scopes.Allowed("unlisted"); err != nil || len(allowed) != 0 {
+			t.Errorf("Allowed of unlisted client = %v, %v, want none whatever OpenScopes", allowed, err)
+		}
+
+		for _, tc := range []struct {
+			clientID string
+			scope    string
+			want     string
+			err      error
+		}{
+			{"client", "write read write", "read write", nil},
+			{"client", "profile admin read", "profile read", nil},
+			{"client", "admin", "", storage.ErrInvalidScope},
+			{"client", "read unknown", "", storage.ErrInvalidScope},
+			{"client", "", "profile read", nil},
+			{"unlisted", "unknown", "", storage.ErrInvalidScope},
+		} {
+			if got, err := scopes.Validate(tc.clientID, tc.scope); got != tc.want || err != tc.err {
+				t.Errorf("open %v: Validate(%q, %q) = %q, %v, want %q, %v", open, tc.clientID, tc.scope, got, err, tc.want, tc.err)
+			}
+		}
+
+		want, wantErr, defaults := "", storage.ErrInvalidScope, ""
+		if open {
+			want, wantErr, defaults = "admin write", nil, "profile read"
+		}
+		if got, err := scopes.Validate("unlisted", "write admin write"); got != want || err != wantErr {
+			t.Errorf("open %v: Validate of unlisted client = %q, %v, want %q, %v", open, got, err, want, wantErr)
+		}
+		if got, err := scopes.Validate("unlisted", ""); got != defaults || err != nil {
+			t.Errorf("open %v: defaults of unlisted client = %q, %v, want %q", open, got, err, defaults)
+		}
+	}
+}
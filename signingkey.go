@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/gislik/gorm"
+)
+
+// JWS algorithms supported by SigningKey
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// SigningKey model, a private key signing JWTs
+type SigningKey struct {
+	ID         string     `gorm:"primary_key"` // Key ID published as kid
+	Algorithm  string     // JWS algorithm, one of RS256, ES256 or EdDSA
+	Use        string     // Public key use published in the JWKS, sig
+	PrivateKey string     `gorm:"type:text"` // PEM encoded PKCS #8 private key, sealed by the KeyStore when Encrypted
+	Encrypted  bool       // PrivateKey is encrypted at rest
+	CreatedAt  time.Time  // Date created, the key signs from then on
+	ExpiresAt  *time.Time // Date after which the key is no longer published. Nil while the key is current
+	RetiredAt  *time.Time // Date the key was retired, it is neither used nor published anymore
+
+	key crypto.Signer
+}
+
+// TableName is used by `gorm`
+func (SigningKey) TableName(db *gorm.DB) string {
+	return gorm.DefaultTableNameHandler(db, "oauth_signing_key")
+}
+
+// Public returns the public key
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+// generateKey generates a private key for alg
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("storage: unsupported signing algorithm %q", alg)
+}
+
+func marshalKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("storage: invalid signing key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("storage: unsupported signing key type")
+	}
+	return signer, nil
+}
+
+// sign returns the JWS signature of data
+func (k *SigningKey) sign(data []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case RS256:
+		digest := sha256.Sum256(data)
+		return k.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ES256:
+		key, ok := k.key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("storage: ES256 key is not an ECDSA key")
+		}
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case EdDSA:
+		return k.key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("storage: unsupported signing algorithm %q", k.Algorithm)
+}
+
+// verify checks the JWS signature sig of data
+func (k *SigningKey) verify(data, sig []byte) bool {
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return k.Algorithm == RS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if k.Algorithm != ES256 || len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		return k.Algorithm == EdDSA && ed25519.Verify(pub, data, sig)
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package sqlstorage
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect selects the placeholder style of the database
+type Dialect int
+
+const (
+	// Postgres uses $1, $2, ... placeholders
+	Postgres Dialect = iota
+	// MySQL uses ? placeholders
+	MySQL
+	// SQLite uses ? placeholders
+	SQLite
+)
+
+// rebind rewrites the ? placeholders of query for the dialect
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,290 @@
+// Package sqlstorage implements osin.Storage directly on database/sql.
+//
+// It uses the same tables and encoding as storage.Storage so both can share a database,
+// without depending on gorm. SaveAccess indexes scopes in oauth_access_scope and JWT access
+// tokens are saved and removed by their jti. Verifying JWT access tokens needs the
+// storage.KeyStore, LoadAccess returns ErrInvalidJWT for them.
+// Hooks, the audit log and the outbox of storage.Storage are not supported.
+// MySQL connections must be opened with parseTime=true.
+package sqlstorage
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/gislik/osin-storage/internal/model"
+	"github.com/openshift/osin"
+)
+
+// ErrNotFound is storage.ErrNotFound. It is returned when nothing matched,
+// by the Remove methods like storage.Storage and by the load methods in place of sql.ErrNoRows.
+var ErrNotFound = model.ErrNotFound
+
+// ErrInvalidJWT is storage.ErrInvalidJWT, returned by LoadAccess for JWT access tokens
+// and by SaveAccess and RemoveAccess for JWTs without a jti.
+var ErrInvalidJWT = model.ErrInvalidJWT
+
+const (
+	clientColumns    = "id, secret, redirect_uri, user_data"
+	openIDColumns    = "subject, nonce, auth_time, acr, max_age, claims"
+	authorizeColumns = "client_id, code, expires_in, scope, redirect_uri, state, created_at, user_data, code_challenge, code_challenge_method, "
+	accessColumns    = "client_id, authorize, prv_access, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, user_data, "
+
+	// openIDSelect reads the OpenID Connect columns, which are NULL in rows saved before they were added
+	openIDSelect = "COALESCE(subject, ''), COALESCE(nonce, ''), auth_time, COALESCE(acr, ''), COALESCE(max_age, 0), COALESCE(claims, '')"
+)
+
+var queries = map[string]string{
+	"getClient":           "SELECT " + clientColumns + " FROM oauth_client WHERE id = ?",
+	"saveClient":          "INSERT INTO oauth_client (" + clientColumns + ") VALUES (?, ?, ?, ?)",
+	"removeClient":        "DELETE FROM oauth_client WHERE id = ?",
+	"saveAuthorize":       "INSERT INTO oauth_authorize (" + authorizeColumns + openIDColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	"loadAuthorize":       "SELECT " + authorizeColumns + openIDSelect + " FROM oauth_authorize WHERE code = ?",
+	"removeAuthorize":     "DELETE FROM oauth_authorize WHERE code = ?",
+	"saveAccess":          "INSERT INTO oauth_access (" + accessColumns + openIDColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	"loadAccess":          "SELECT " + accessColumns + openIDSelect + " FROM oauth_access WHERE access_token = ?",
+	"removeAccess":        "DELETE FROM oauth_access WHERE access_token = ?",
+	"loadRefresh":         "SELECT " + accessColumns + openIDSelect + " FROM oauth_access WHERE refresh_token = ?",
+	"removeRefresh":       "DELETE FROM oauth_access WHERE refresh_token = ?",
+	"saveScope":           "INSERT INTO oauth_access_scope (access_token, scope) VALUES (?, ?)",
+	"removeScopes":        "DELETE FROM oauth_access_scope WHERE access_token = ?",
+	"removeRefreshScopes": "DELETE FROM oauth_access_scope WHERE access_token IN (SELECT access_token FROM oauth_access WHERE refresh_token = ?)",
+}
+
+// Storage implements osin.Storage with prepared statements
+type Storage struct {
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+// New prepares the statements for dialect on db.
+// The tables must exist, see storage.Storage for their layout.
+func New(db *sql.DB, dialect Dialect) (*Storage, error) {
+	s := &Storage{db: db, stmts: make(map[string]*sql.Stmt, len(queries))}
+	for name, query := range queries {
+		stmt, err := db.Prepare(dialect.rebind(query))
+		if err != nil {
+			s.Release()
+			return nil, err
+		}
+		s.stmts[name] = stmt
+	}
+	return s, nil
+}
+
+// Clone the storage if needed.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close is called by osin after each request and does nothing, see Release
+func (s *Storage) Close() {
+}
+
+// Release closes the prepared statements. The storage must not be used afterwards.
+func (s *Storage) Release() error {
+	var err error
+	for _, stmt := range s.stmts {
+		if e := stmt.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// GetClient loads the client by id (client_id)
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var c model.Client
+	err := s.stmts["getClient"].QueryRow(id).Scan(&c.ID, &c.Secret, &c.RedirectUri, &c.UserData)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return c.ToOsin(), nil
+}
+
+// SaveClient saves client
+func (s *Storage) SaveClient(c osin.Client) error {
+	cl, err := model.ClientFromOsin(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.stmts["saveClient"].Exec(cl.ID, cl.Secret, cl.RedirectUri, cl.UserData)
+	return err
+}
+
+// RemoveClient removes the client with matching id
+func (s *Storage) RemoveClient(id string) error {
+	return s.remove("removeClient", id)
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	a, err := model.AuthorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.stmts["saveAuthorize"].Exec(a.ClientID, a.Code, a.ExpiresIn, a.Scope, a.RedirectUri, a.State,
+		a.CreatedAt, a.UserData, a.CodeChallenge, a.CodeChallengeMethod,
+		a.Subject, a.Nonce, a.AuthTime, a.ACR, a.MaxAge, a.Claims)
+	return err
+}
+
+// LoadAuthorize looks up AuthorizeData by a code.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	a, err := s.loadAuthorize(code)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.GetClient(a.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return a.ToOsin(c), nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	return s.remove("removeAuthorize", code)
+}
+
+// SaveAccess writes AccessData and indexes its scopes in a transaction.
+// JWT access tokens are saved under their jti.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	a, err := model.AccessFromOsin(data)
+	if err != nil {
+		return err
+	}
+	if a.AccessToken, err = model.AccessTokenID(data.AccessToken); err != nil {
+		return err
+	}
+	return s.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(s.stmts["saveAccess"]).Exec(a.ClientID, a.Authorize, a.PrvAccess, a.AccessToken, a.RefreshToken,
+			a.ExpiresIn, a.Scope, a.RedirectUri, a.CreatedAt, a.UserData,
+			a.Subject, a.Nonce, a.AuthTime, a.ACR, a.MaxAge, a.Claims)
+		if err != nil {
+			return err
+		}
+		saveScope := tx.Stmt(s.stmts["saveScope"])
+		for _, scope := range strings.Fields(model.NormalizeScope(a.Scope)) {
+			if _, err := saveScope.Exec(a.AccessToken, scope); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadAccess retrieves access data by token.
+// JWT access tokens cannot be verified without the storage.KeyStore and return ErrInvalidJWT.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	if model.IsJWT(code) {
+		return nil, ErrInvalidJWT
+	}
+	return s.loadAccess("loadAccess", code)
+}
+
+// RemoveAccess revokes or deletes an AccessData together with its scopes.
+// JWT access tokens are removed by their jti.
+func (s *Storage) RemoveAccess(code string) error {
+	id, err := model.AccessTokenID(code)
+	if err != nil {
+		return err
+	}
+	return s.removeAccess("removeScopes", "removeAccess", id)
+}
+
+// LoadRefresh retrieves refresh AccessData.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	return s.loadAccess("loadRefresh", code)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData together with its scopes.
+func (s *Storage) RemoveRefresh(code string) error {
+	return s.removeAccess("removeRefreshScopes", "removeRefresh", code)
+}
+
+func (s *Storage) loadAuthorize(code string) (*model.Authorize, error) {
+	var a model.Authorize
+	err := s.stmts["loadAuthorize"].QueryRow(code).Scan(&a.ClientID, &a.Code, &a.ExpiresIn, &a.Scope, &a.RedirectUri,
+		&a.State, &a.CreatedAt, &a.UserData, &a.CodeChallenge, &a.CodeChallengeMethod,
+		&a.Subject, &a.Nonce, &a.AuthTime, &a.ACR, &a.MaxAge, &a.Claims)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &a, nil
+}
+
+// loadAccess loads the access data returned by the named statement with its client and authorize data.
+// Missing authorize data is not an error.
+func (s *Storage) loadAccess(name string, code string) (*osin.AccessData, error) {
+	var a model.Access
+	err := s.stmts[name].QueryRow(code).Scan(&a.ClientID, &a.Authorize, &a.PrvAccess, &a.AccessToken, &a.RefreshToken,
+		&a.ExpiresIn, &a.Scope, &a.RedirectUri, &a.CreatedAt, &a.UserData,
+		&a.Subject, &a.Nonce, &a.AuthTime, &a.ACR, &a.MaxAge, &a.Claims)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	c, err := s.GetClient(a.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	oa := a.ToOsin(c)
+	if a.Authorize != "" {
+		if authorize, err := s.loadAuthorize(a.Authorize); err == nil && authorize.ClientID == a.ClientID {
+			oa.AuthorizeData = authorize.ToOsin(c)
+		}
+	}
+	return oa, nil
+}
+
+// removeAccess executes the named delete statements of the scopes and of the access data in a transaction,
+// returning ErrNotFound when no access data matched
+func (s *Storage) removeAccess(scopes, name string, arg string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Stmt(s.stmts[scopes]).Exec(arg); err != nil {
+			return err
+		}
+		return affected(tx.Stmt(s.stmts[name]).Exec(arg))
+	})
+}
+
+// remove executes the named delete statement, returning ErrNotFound when nothing matched
+func (s *Storage) remove(name string, arg string) error {
+	return affected(s.stmts[name].Exec(arg))
+}
+
+// transaction runs fn in a transaction committed when fn returns nil
+func (s *Storage) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// affected reports the outcome of a delete statement, ErrNotFound when nothing matched
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
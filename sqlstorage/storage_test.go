@@ -0,0 +1,121 @@
+package sqlstorage
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// newStorage returns a Storage on the database of storagetest.OpenDB,
+// which creates the tables with gorm in the test binary only
+func newStorage(t *testing.T) *Storage {
+	return newSharedStorage(t, storagetest.OpenDB(t))
+}
+
+// newSharedStorage returns a Storage on db
+func newSharedStorage(t *testing.T, db *gorm.DB) *Storage {
+	dialect := SQLite
+	switch os.Getenv("STORAGE_TEST_DIALECT") {
+	case "postgres":
+		dialect = Postgres
+	case "mysql":
+		dialect = MySQL
+	}
+	s, err := New(db.DB(), dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Release() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		return newStorage(t)
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	s := newStorage(t)
+	if _, err := s.GetClient("missing"); err != ErrNotFound {
+		t.Errorf("GetClient of missing client = %v, want ErrNotFound", err)
+	}
+	if err := s.RemoveAccess("missing"); err != ErrNotFound {
+		t.Errorf("RemoveAccess of missing token = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSharedDatabase(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	s := newSharedStorage(t, db)
+	shared := storage.NewStorage(db)
+	client := &osin.DefaultClient{Id: "shared", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"shared-jti"}`)) + ".signature"
+	data := &osin.AccessData{Client: client, AccessToken: jwt, RefreshToken: "shared-refresh", ExpiresIn: 3600, Scope: "read write read", CreatedAt: time.Now()}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := shared.FindAccessByScope("write")
+	if err != nil || len(found) != 1 || found[0].AccessToken != "shared-jti" {
+		t.Fatalf("FindAccessByScope = %v, %v, want the access data under its jti", found, err)
+	}
+	if _, err := s.LoadAccess(jwt); err != ErrInvalidJWT {
+		t.Errorf("LoadAccess of JWT = %v, want ErrInvalidJWT", err)
+	}
+	if err := s.RemoveAccess(jwt); err != nil {
+		t.Fatalf("RemoveAccess: %v", err)
+	}
+	if found, err := shared.FindAccessByScope("read"); err != nil || len(found) != 0 {
+		t.Errorf("FindAccessByScope after RemoveAccess = %v, %v, want none", found, err)
+	}
+	var n int
+	if err := db.Model(&storage.AccessScope{}).Count(&n).Error; err != nil || n != 0 {
+		t.Errorf("%d scopes left after RemoveAccess, %v", n, err)
+	}
+}
+
+func TestNullOpenIDColumns(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	s := newSharedStorage(t, db)
+	client := &osin.DefaultClient{Id: "null-openid", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	// rows saved before the OpenID Connect columns were added have NULL in them
+	err := db.Exec("INSERT INTO oauth_authorize (client_id, code, expires_in, scope, redirect_uri, state, created_at, user_data, code_challenge, code_challenge_method,"+
+		" subject, nonce, auth_time, acr, max_age, claims) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL, NULL, NULL, NULL, NULL)",
+		client.Id, "null-code", 600, "read", client.RedirectUri, "", time.Now(), "", "", "").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("INSERT INTO oauth_access (client_id, authorize, prv_access, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, user_data,"+
+		" subject, nonce, auth_time, acr, max_age, claims) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL, NULL, NULL, NULL, NULL)",
+		client.Id, "null-code", "", "null-access", "null-refresh", 3600, "read", client.RedirectUri, time.Now(), "").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := s.LoadAuthorize("null-code"); err != nil || a.UserData != nil {
+		t.Errorf("LoadAuthorize = %v, %v, want no UserData", a, err)
+	}
+	a, err := s.LoadAccess("null-access")
+	if err != nil {
+		t.Fatalf("LoadAccess: %v", err)
+	}
+	if a.UserData != nil || a.AuthorizeData == nil {
+		t.Errorf("LoadAccess = %+v, want the authorize data and no UserData", a)
+	}
+	if _, err := s.LoadRefresh("null-refresh"); err != nil {
+		t.Errorf("LoadRefresh: %v", err)
+	}
+}
@@ -1,18 +1,85 @@
 package storage
 
 import (
-	"encoding/json"
+	"context"
 
 	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage/internal/model"
 	"github.com/openshift/osin"
 )
 
+// ErrNotFound is returned by the Remove methods when nothing matched
+var ErrNotFound = model.ErrNotFound
+
+// ContextKey is the gorm setting holding the context passed to WithContext, for gorm callbacks
+const ContextKey = "osin-storage:context"
+
 type Storage struct {
-	db *gorm.DB
+	db         *gorm.DB
+	idempotent bool
+	validate   bool
+	keys       *KeyStore
+	audit      bool
+	outbox     bool
+	ctx        context.Context
+	hooks      []Hooks
+	dispatcher Dispatcher
+}
+
+// Option configures a Storage
+type Option func(*Storage)
+
+// IdempotentRemove makes the Remove methods succeed when nothing was deleted
+// instead of returning ErrNotFound.
+func IdempotentRemove() Option {
+	return func(s *Storage) {
+		s.idempotent = true
+	}
+}
+
+// ValidateTokens makes LoadAuthorize, LoadAccess and LoadRefresh return ErrMalformedToken
+// without querying the database for tokens not generated by TokenGen.
+func ValidateTokens() Option {
+	return func(s *Storage) {
+		s.validate = true
+	}
+}
+
+// WithKeyStore lets the storage resolve JWT access tokens signed with the keys of ks
+func WithKeyStore(ks *KeyStore) Option {
+	return func(s *Storage) {
+		s.keys = ks
+	}
+}
+
+// WithAudit records every mutation in the oauth_audit table, see AuditEvent
+func WithAudit() Option {
+	return func(s *Storage) {
+		s.audit = true
+	}
+}
+
+func NewStorage(db *gorm.DB, opts ...Option) *Storage {
+	s := &Storage{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func NewStorage(db *gorm.DB) *Storage {
-	return &Storage{db}
+// WithContext returns a copy of the storage using ctx, e.g. a context returned by RequestContext
+// so the audit log records the client IP and user agent.
+// gorm callbacks find ctx in the ContextKey setting.
+func (s *Storage) WithContext(ctx context.Context) *Storage {
+	c := *s
+	c.ctx = ctx
+	c.db = s.db.Set(ContextKey, ctx)
+	return &c
+}
+
+// StorageWithContext is WithContext returning an osin.Storage, for wrappers like otelstorage
+func (s *Storage) StorageWithContext(ctx context.Context) osin.Storage {
+	return s.WithContext(ctx)
 }
 
 // Clone the storage if needed. For example, using mgo, you can clone the session with session.Clone
@@ -27,228 +94,409 @@ func (s *Storage) Clone() osin.Storage {
 func (s *Storage) Close() {
 }
 
-var err error
-
 // GetClient loads the client by id (client_id)
 func (s *Storage) GetClient(id string) (osin.Client, error) {
 	var c Client
-
-	if err = s.db.Where("id = ?", id).First(&c).Error; err == nil {
-		oc := osin.DefaultClient{
-			Id:          c.ID,
-			Secret:      c.Secret,
-			RedirectUri: c.RedirectUri,
-			UserData:    c.UserData,
-		}
-		return &oc, nil
+	if err := s.db.Where("id = ?", id).First(&c).Error; err != nil {
+		return nil, err
 	}
-	return nil, err
+	return c.ToOsin(), nil
 }
 
 // SaveClient saves client
 func (s *Storage) SaveClient(c osin.Client) error {
-	client := Client{
-		ID:          c.GetId(),
-		Secret:      c.GetSecret(),
-		RedirectUri: c.GetRedirectUri(),
-	}
-	if c.GetUserData() != nil {
-		v, err := userDataToString(c.GetUserData())
-		if err != nil {
+	client, err := ClientFromOsin(c)
+	if err != nil {
+		return err
+	}
+	ctx := s.context()
+	err = s.before(func(h *Hooks) error {
+		if h.BeforeClientSaved == nil {
+			return nil
+		}
+		return h.BeforeClientSaved(ctx, c)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&client).Error; err != nil {
 			return err
 		}
-		client.UserData = v
+		return s.record(tx, EventClientSaved, client.ID, "", "")
+	})
+	if err != nil {
+		return err
 	}
-	return s.db.Create(&client).Error
-
+	s.after(func(h *Hooks) {
+		if h.OnClientSaved != nil {
+			h.OnClientSaved(ctx, c)
+		}
+	})
+	return nil
 }
 
 // RemoveClient removes the client with matching id
 func (s *Storage) RemoveClient(id string) error {
-	var a Client
-	if err = s.db.Where("id = ?", id).First(&a).Error; err == nil {
-		if err = s.db.Delete(&a).Error; err == nil {
+	ctx := s.context()
+	err := s.before(func(h *Hooks) error {
+		if h.BeforeClientRemoved == nil {
 			return nil
 		}
+		return h.BeforeClientRemoved(ctx, id)
+	})
+	if err != nil {
 		return err
 	}
-	return err
+	removed := false
+	err = s.transaction(func(tx *gorm.DB) error {
+		db := tx.Where("id = ?", id).Delete(&Client{})
+		if err := s.remove(db); err != nil || db.RowsAffected == 0 {
+			return err
+		}
+		removed = true
+		return s.record(tx, EventClientRemoved, id, "", "")
+	})
+	if err != nil || !removed {
+		return err
+	}
+	s.after(func(h *Hooks) {
+		if h.OnClientRemoved != nil {
+			h.OnClientRemoved(ctx, id)
+		}
+	})
+	return nil
 }
 
 // SaveAuthorize saves authorize data.
 func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
-	authorize := Authorize{
-		ClientID:            data.Client.GetId(),
-		Code:                data.Code,
-		ExpiresIn:           data.ExpiresIn,
-		RedirectUri:         data.RedirectUri,
-		Scope:               data.Scope,
-		State:               data.State,
-		CreatedAt:           data.CreatedAt,
-		CodeChallenge:       data.CodeChallenge,
-		CodeChallengeMethod: data.CodeChallengeMethod,
-	}
-	if data.UserData != nil {
-		v, err := userDataToString(data.UserData)
-		if err != nil {
+	authorize, err := AuthorizeFromOsin(data)
+	if err != nil {
+		return err
+	}
+	ctx := s.context()
+	err = s.before(func(h *Hooks) error {
+		if h.BeforeAuthorizeSaved == nil {
+			return nil
+		}
+		return h.BeforeAuthorizeSaved(ctx, data)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&authorize).Error; err != nil {
 			return err
 		}
-		authorize.UserData = v
+		return s.record(tx, EventAuthorizeSaved, authorize.ClientID, authorize.Subject, authorize.Code)
+	})
+	if err != nil {
+		return err
 	}
-	return s.db.Create(&authorize).Error
+	// On hooks may run after SaveAuthorize returned, they get a copy the caller cannot change under them
+	saved := *data
+	s.after(func(h *Hooks) {
+		if h.OnAuthorizeSaved != nil {
+			h.OnAuthorizeSaved(ctx, &saved)
+		}
+	})
+	return nil
 }
 
 // LoadAuthorize looks up AuthorizeData by a code.
-// Client information MUST be loaded together.
+// Client information MUST be loaded together, by a second query.
 // Optionally can return error if expired.
 func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	if s.validate && !ValidToken(AuthorizeTokenPrefix, code) {
+		return nil, ErrMalformedToken
+	}
 	var authorize Authorize
-	if err = s.db.Where("code = ?", code).First(&authorize).Error; err == nil {
-		client, err := s.GetClient(authorize.ClientID)
-		if err != nil {
-			return nil, err
-		}
-		oa := &osin.AuthorizeData{
-			Client:              client,
-			Code:                authorize.Code,
-			ExpiresIn:           authorize.ExpiresIn,
-			Scope:               authorize.Scope,
-			RedirectUri:         authorize.RedirectUri,
-			State:               authorize.State,
-			CreatedAt:           authorize.CreatedAt,
-			CodeChallenge:       authorize.CodeChallenge,
-			CodeChallengeMethod: authorize.CodeChallengeMethod,
-		}
-
-		if authorize.UserData != "" {
-			oa.UserData = authorize.UserData
-		}
-		return oa, nil
+	if err := s.db.Preload("Client").Where("code = ?", code).First(&authorize).Error; err != nil {
+		return nil, err
+	}
+	if authorize.Client.ID == "" {
+		return nil, gorm.ErrRecordNotFound
 	}
-	return nil, err
+	return authorize.ToOsin(authorize.Client.ToOsin()), nil
 }
 
 // RemoveAuthorize revokes or deletes the authorization code.
 func (s *Storage) RemoveAuthorize(code string) error {
-	var a Authorize
-	if err = s.db.Where("code = ?", code).First(&a).Error; err == nil {
-		if err = s.db.Delete(&a).Error; err == nil {
+	ctx := s.context()
+	err := s.before(func(h *Hooks) error {
+		if h.BeforeAuthorizeRemoved == nil {
 			return nil
 		}
+		return h.BeforeAuthorizeRemoved(ctx, code)
+	})
+	if err != nil {
+		return err
+	}
+	removed := false
+	if !s.recording() {
+		// nothing records the removal, the delete alone tells whether the code existed
+		db := s.db.Where("code = ?", code).Delete(&Authorize{})
+		removed = db.RowsAffected > 0
+		err = s.remove(db)
+	} else {
+		err = s.transaction(func(tx *gorm.DB) error {
+			var a Authorize
+			if err := tx.Select("client_id, subject").Where("code = ?", code).Find(&a).Error; err != nil && err != gorm.ErrRecordNotFound {
+				return err
+			}
+			db := tx.Where("code = ?", code).Delete(&Authorize{})
+			if err := s.remove(db); err != nil || db.RowsAffected == 0 {
+				return err
+			}
+			removed = true
+			return s.record(tx, EventAuthorizeRemoved, a.ClientID, a.Subject, code)
+		})
+	}
+	if err != nil || !removed {
 		return err
 	}
-	return err
+	s.after(func(h *Hooks) {
+		if h.OnAuthorizeRemoved != nil {
+			h.OnAuthorizeRemoved(ctx, code)
+		}
+	})
+	return nil
 }
 
 // SaveAccess writes AccessData.
 // If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
+// JWT access tokens are saved under their jti.
+// The access data and its scopes are saved in a transaction.
 func (s *Storage) SaveAccess(data *osin.AccessData) error {
-	access := Access{
-		ClientID:     data.Client.GetId(),
-		AccessToken:  data.AccessToken,
-		RefreshToken: data.RefreshToken,
-		ExpiresIn:    data.ExpiresIn,
-		Scope:        data.Scope,
-		RedirectUri:  data.RedirectUri,
-		CreatedAt:    data.CreatedAt,
-	}
-
-	if data.UserData != nil {
-		v, err := userDataToString(data.UserData)
-		if err != nil {
-			return err
-		}
-		access.UserData = v
-	}
+	return s.saveAccess(data, nil)
+}
 
-	if data.AccessData != nil {
-		access.PrvAccess = data.AccessData.AccessToken
+// saveAccess saves data, running consume in the same transaction when set
+// so that the grant exchanged for the access data is used up only when it is saved
+func (s *Storage) saveAccess(data *osin.AccessData, consume func(tx *gorm.DB) error) error {
+	access, err := AccessFromOsin(data)
+	if err != nil {
+		return err
 	}
-
-	if data.AuthorizeData != nil {
-		access.Authorize = data.AuthorizeData.Code
+	if access.AccessToken, err = accessTokenID(data.AccessToken); err != nil {
+		return err
 	}
-
-	return s.db.Create(&access).Error
+	ctx := s.context()
+	err = s.before(func(h *Hooks) error {
+		if h.BeforeAccessSaved == nil {
+			return nil
+		}
+		return h.BeforeAccessSaved(ctx, data)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.transaction(func(tx *gorm.DB) error {
+		if consume != nil {
+			if err := consume(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&access).Error; err != nil {
+			return err
+		}
+		if err := saveAccessScopes(tx, &access); err != nil {
+			return err
+		}
+		return s.record(tx, EventAccessSaved, access.ClientID, access.Subject, access.AccessToken)
+	})
+	if err != nil {
+		return err
+	}
+	saved := *data
+	s.after(func(h *Hooks) {
+		if h.OnAccessSaved != nil {
+			h.OnAccessSaved(ctx, &saved)
+		}
+	})
+	return nil
 }
 
 // LoadAccess retrieves access data by token. Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
 // Optionally can return error if expired.
+// JWT access tokens are verified, signature, expiry and audience, and looked up by their jti.
+// The AccessToken of the returned access data is the presented token, LoadRefresh returns the jti.
 func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
-	var a Access
-	if err = s.db.Where("access_token = ?", code).First(&a).Error; err == nil {
-		client, err := s.GetClient(a.ClientID)
-		if err != nil {
-			return nil, err
-		}
-		authorize, err := s.LoadAuthorize(a.Authorize)
-
-		oa := &osin.AccessData{
-			Client:        client,
-			AuthorizeData: authorize,
-			AccessToken:   a.AccessToken,
-			RefreshToken:  a.RefreshToken,
-			ExpiresIn:     a.ExpiresIn,
-			Scope:         a.Scope,
-			RedirectUri:   a.RedirectUri,
-			CreatedAt:     a.CreatedAt,
-		}
-		if a.UserData != "" {
-			oa.UserData = a.UserData
-		}
-		return oa, nil
+	if s.validate && !isJWT(code) && !ValidToken(AccessTokenPrefix, code) {
+		return nil, ErrMalformedToken
+	}
+	if !isJWT(code) {
+		return s.loadAccess("access_token = ?", code)
 	}
-	return nil, err
+	id, err := s.verifyAccessToken(code)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.loadAccess("access_token = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	data.AccessToken = code
+	return data, nil
 }
 
 // RemoveAccess revokes or deletes an AccessData.
+// JWT access tokens are removed by their jti, even when their signing key is no longer published.
 func (s *Storage) RemoveAccess(code string) error {
-	var a Access
-	if err = s.db.Where("access_token = ?", code).First(&a).Error; err == nil {
-		if err = s.db.Delete(&a).Error; err == nil {
+	id, err := accessTokenID(code)
+	if err != nil {
+		return err
+	}
+	ctx := s.context()
+	err = s.before(func(h *Hooks) error {
+		if h.BeforeAccessRemoved == nil {
 			return nil
 		}
+		return h.BeforeAccessRemoved(ctx, code)
+	})
+	if err != nil {
+		return err
+	}
+	removed, err := s.removeAccess(EventAccessRemoved, "access_token = ?", id)
+	if err != nil || !removed {
 		return err
 	}
-	return err
+	s.after(func(h *Hooks) {
+		if h.OnAccessRemoved != nil {
+			h.OnAccessRemoved(ctx, code)
+		}
+	})
+	return nil
 }
 
 // LoadRefresh retrieves refresh AccessData. Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
 // Optionally can return error if expired.
 func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
-	var (
-		a Access
-	)
-	if err = s.db.Where("refresh_token = ?", code).First(&a).Error; err == nil {
-		return s.LoadAccess(a.AccessToken)
+	if s.validate && !ValidToken(RefreshTokenPrefix, code) {
+		return nil, ErrMalformedToken
 	}
-	return nil, err
+	return s.loadAccess("refresh_token = ?", code)
 }
 
 // RemoveRefresh revokes or deletes refresh AccessData.
 func (s *Storage) RemoveRefresh(code string) error {
-	var a Access
-	if err = s.db.Where("refresh_token = ?", code).First(&a).Error; err == nil {
-		if err = s.db.Delete(&a).Error; err == nil {
+	ctx := s.context()
+	err := s.before(func(h *Hooks) error {
+		if h.BeforeRefreshRemoved == nil {
 			return nil
 		}
+		return h.BeforeRefreshRemoved(ctx, code)
+	})
+	if err != nil {
+		return err
+	}
+	removed, err := s.removeAccess(EventRefreshRemoved, "refresh_token = ?", code)
+	if err != nil || !removed {
 		return err
 	}
-	return err
+	s.after(func(h *Hooks) {
+		if h.OnRefreshRemoved != nil {
+			h.OnRefreshRemoved(ctx, code)
+		}
+	})
+	return nil
 }
 
-func userDataToString(userData interface{}) (string, error) {
-	if userData == nil {
-		return "", nil
+// loadAccess loads the access data matching query together with its client and authorize data.
+// Preload runs one query per association, so this is three queries: the access row, its client
+// and its authorize data, plus a GetClient when the authorize data belongs to another client.
+// Missing authorize data is not an error.
+func (s *Storage) loadAccess(query string, code string) (*osin.AccessData, error) {
+	var a Access
+	if err := s.db.Preload("Client").Preload("AuthorizeData").Where(query, code).First(&a).Error; err != nil {
+		return nil, err
 	}
-	if s, ok := userData.(string); ok {
-		return s, nil
+	return s.accessToOsin(&a)
+}
+
+// accessToOsin converts access data loaded with its client and authorize data
+func (s *Storage) accessToOsin(a *Access) (*osin.AccessData, error) {
+	if a.Client.ID == "" {
+		return nil, gorm.ErrRecordNotFound
 	}
-	v, err := json.Marshal(userData)
-	if err != nil {
-		return "", err
+	client := a.Client.ToOsin()
+	oa := a.ToOsin(client)
+	if authorize := a.AuthorizeData; authorize.Code != "" {
+		if authorize.ClientID == a.ClientID {
+			oa.AuthorizeData = authorize.ToOsin(client)
+		} else if c, err := s.GetClient(authorize.ClientID); err == nil {
+			oa.AuthorizeData = authorize.ToOsin(c)
+		}
+	}
+	return oa, nil
+}
+
+// removeAccess deletes the access data matching query together with its scopes, records event
+// for each of them with the fingerprint of code and reports whether any was removed
+func (s *Storage) removeAccess(event, query string, code string) (bool, error) {
+	if !s.recording() {
+		// nothing records the removal, the scopes are deleted through a subquery without loading the rows
+		removed := false
+		err := s.transaction(func(tx *gorm.DB) error {
+			tokens := "SELECT access_token FROM " + Access{}.TableName(tx) + " WHERE " + query
+			if err := tx.Where("access_token IN ("+tokens+")", code).Delete(&AccessScope{}).Error; err != nil {
+				return err
+			}
+			db := tx.Where(query, code).Delete(&Access{})
+			removed = db.RowsAffected > 0
+			return s.remove(db)
+		})
+		return removed, err
+	}
+	var removed []Access
+	err := s.transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("access_token, client_id, subject").Where(query, code).Find(&removed).Error; err != nil {
+			return err
+		}
+		if err := s.remove(tx.Where(query, code).Delete(&Access{})); err != nil {
+			return err
+		}
+		for _, a := range removed {
+			if err := tx.Where("access_token = ?", a.AccessToken).Delete(&AccessScope{}).Error; err != nil {
+				return err
+			}
+			if err := s.record(tx, event, a.ClientID, a.Subject, code); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(removed) > 0, err
+}
+
+// recording reports whether removals are recorded in the audit log or the outbox,
+// which need the client and subject of the removed rows
+func (s *Storage) recording() bool {
+	return s.audit || s.outbox
+}
+
+// transaction runs fn in a transaction committed when fn returns nil
+func (s *Storage) transaction(fn func(tx *gorm.DB) error) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// remove reports the outcome of a delete statement
+func (s *Storage) remove(db *gorm.DB) error {
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 && !s.idempotent {
+		return ErrNotFound
 	}
-	return string(v), nil
+	return nil
 }
@@ -0,0 +1,110 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gislik/gorm"
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+// countQueries counts the SELECT statements run on db, preloads included
+func countQueries(db *gorm.DB) *int {
+	n := new(int)
+	count := func(*gorm.Scope) { *n++ }
+	db.Callback().Query().After("gorm:query").Register("storage_bench:count", count)
+	db.Callback().RowQuery().After("gorm:row_query").Register("storage_bench:count", count)
+	return n
+}
+
+// benchStorage returns a storage holding a client, an authorization code and an access token issued for it
+func benchStorage(b *testing.B) (*storage.Storage, *gorm.DB, *osin.AccessData) {
+	db := storagetest.OpenDB(b)
+	s := storage.NewStorage(db)
+	client := &osin.DefaultClient{Id: fmt.Sprintf("bench-%d", time.Now().UnixNano()), Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		b.Fatal(err)
+	}
+	authorize := &osin.AuthorizeData{
+		Client:      client,
+		Code:        client.Id + "-code",
+		ExpiresIn:   600,
+		RedirectUri: client.RedirectUri,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.SaveAuthorize(authorize); err != nil {
+		b.Fatal(err)
+	}
+	access := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessToken:   client.Id + "-access",
+		RefreshToken:  client.Id + "-refresh",
+		ExpiresIn:     3600,
+		RedirectUri:   client.RedirectUri,
+		CreatedAt:     time.Now(),
+	}
+	if err := s.SaveAccess(access); err != nil {
+		b.Fatal(err)
+	}
+	return s, db, access
+}
+
+// benchmark runs load b.N times and reports the queries run per call
+func benchmark(b *testing.B, db *gorm.DB, load func() error) {
+	queries := countQueries(db)
+	b.ReportAllocs()
+	b.ResetTimer()
+	*queries = 0
+	for i := 0; i < b.N; i++ {
+		if err := load(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+}
+
+func BenchmarkGetClient(b *testing.B) {
+	s, db, access := benchStorage(b)
+	benchmark(b, db, func() error {
+		_, err := s.GetClient(access.Client.GetId())
+		return err
+	})
+}
+
+func BenchmarkLoadAuthorize(b *testing.B) {
+	s, db, access := benchStorage(b)
+	benchmark(b, db, func() error {
+		_, err := s.LoadAuthorize(access.AuthorizeData.Code)
+		return err
+	})
+}
+
+func BenchmarkLoadAccess(b *testing.B) {
+	s, db, access := benchStorage(b)
+	benchmark(b, db, func() error {
+		_, err := s.LoadAccess(access.AccessToken)
+		return err
+	})
+}
+
+func BenchmarkLoadRefresh(b *testing.B) {
+	s, db, access := benchStorage(b)
+	benchmark(b, db, func() error {
+		_, err := s.LoadRefresh(access.RefreshToken)
+		return err
+	})
+}
+
+func BenchmarkCachingLoadAccess(b *testing.B) {
+	s, db, access := benchStorage(b)
+	cs := storage.NewCachingStorage(s, nil)
+	benchmark(b, db, func() error {
+		_, err := cs.LoadAccess(access.AccessToken)
+		return err
+	})
+}
@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, storage.NewStorage(storagetest.OpenDB(t)))
+}
+
+func TestFlows(t *testing.T) {
+	storagetest.RunFlows(t, storage.NewStorage(storagetest.OpenDB(t)))
+}
+
+func TestCachingStorage(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		return storage.NewCachingStorage(storage.NewStorage(storagetest.OpenDB(t)), nil)
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.RunConformance(t, func() osin.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestMemoryStorageRemoveMissing(t *testing.T) {
+	for _, tc := range []struct {
+		opts []storage.Option
+		want error
+	}{
+		{nil, storage.ErrNotFound},
+		{[]storage.Option{storage.IdempotentRemove()}, nil},
+	} {
+		s := storage.NewMemoryStorage(tc.opts...)
+		for name, remove := range map[string]func(string) error{
+			"RemoveClient":    s.RemoveClient,
+			"RemoveAuthorize": s.RemoveAuthorize,
+			"RemoveAccess":    s.RemoveAccess,
+			"RemoveRefresh":   s.RemoveRefresh,
+		} {
+			if err := remove("missing"); err != tc.want {
+				t.Errorf("%s of missing entity = %v, want %v", name, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestMemoryStorageOptions(t *testing.T) {
+	s := storage.NewMemoryStorage(storage.ValidateTokens())
+	if _, err := s.LoadAccess("unprefixed"); err != storage.ErrMalformedToken {
+		t.Errorf("LoadAccess of unprefixed token = %v, want ErrMalformedToken", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewMemoryStorage with WithAudit did not panic")
+		}
+	}()
+	storage.NewMemoryStorage(storage.WithAudit())
+}
+
+func TestMemoryStorageSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oauth.json")
+	s := storage.NewMemoryStorage()
+	client := &osin.DefaultClient{Id: "snapshot", Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	authorize := &osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 600, Scope: "read", RedirectUri: client.RedirectUri, CreatedAt: time.Now()}
+	if err := s.SaveAuthorize(authorize); err != nil {
+		t.Fatal(err)
+	}
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 3600, Scope: "read", CreatedAt: time.Now()}
+	if err := s.SaveAccess(access); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	restored := storage.NewMemoryStorage()
+	if err := restored.Restore(path); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if c, err := restored.GetClient(client.Id); err != nil || c.GetSecret() != client.Secret {
+		t.Errorf("GetClient = %v, %v", c, err)
+	}
+	if a, err := restored.LoadAuthorize("code"); err != nil || a.Scope != "read" {
+		t.Errorf("LoadAuthorize = %v, %v", a, err)
+	}
+	a, err := restored.LoadRefresh("refresh")
+	if err != nil {
+		t.Fatalf("LoadRefresh: %v", err)
+	}
+	if a.AccessToken != "access" || a.AuthorizeData == nil || a.AuthorizeData.Code != "code" {
+		t.Errorf("LoadRefresh = %+v, want the access token and its authorize data", a)
+	}
+}
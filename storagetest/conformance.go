@@ -0,0 +1,359 @@
+package storagetest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+)
+
+// ClientSaver is implemented by storages able to create clients.
+// RunConformance needs it to set up the clients tokens are issued to.
+type ClientSaver interface {
+	SaveClient(osin.Client) error
+}
+
+// ClientRemover is implemented by storages able to remove clients
+type ClientRemover interface {
+	RemoveClient(id string) error
+}
+
+// RunConformance checks that the storages returned by newStorage behave like storage.Storage,
+// the reference implementation: save, load and remove semantics for clients, authorize and access data,
+// refresh token lookup, PKCE field, UserData and OpenID Connect parameter preservation, expiry and concurrent use.
+// The storages must implement ClientSaver.
+func RunConformance(t *testing.T, newStorage func() osin.Storage) {
+	run := func(name string, f func(*testing.T, osin.Storage)) {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage()
+			defer s.Close()
+			if _, ok := s.(ClientSaver); !ok {
+				t.Fatalf("%T does not implement SaveClient", s)
+			}
+			f(t, s)
+		})
+	}
+	run("Client", testClient)
+	run("Authorize", testAuthorize)
+	run("Access", testAccess)
+	run("Refresh", testRefresh)
+	run("OpenID", testOpenID)
+	run("Expiry", testExpiry)
+	run("Concurrency", testConcurrency)
+}
+
+func testClient(t *testing.T, s osin.Storage) {
+	client := &osin.DefaultClient{
+		Id:          unique("client"),
+		Secret:      "secret",
+		RedirectUri: "http://localhost/cb",
+		UserData:    map[string]string{"name": "test"},
+	}
+	if err := s.(ClientSaver).SaveClient(client); err != nil {
+		t.Fatalf("SaveClient: %v", err)
+	}
+
+	c, err := s.GetClient(client.Id)
+	if err != nil {
+		t.Fatalf("GetClient: %v", err)
+	}
+	if c.GetId() != client.Id || c.GetSecret() != client.Secret || c.GetRedirectUri() != client.RedirectUri {
+		t.Errorf("GetClient = %+v, want %+v", c, client)
+	}
+	if got, want := c.GetUserData(), `{"name":"test"}`; got != want {
+		t.Errorf("UserData = %v, want %v", got, want)
+	}
+	if _, err := s.GetClient(unique("missing")); err == nil {
+		t.Error("GetClient of missing client succeeded")
+	}
+
+	r, ok := s.(ClientRemover)
+	if !ok {
+		return
+	}
+	if err := r.RemoveClient(client.Id); err != nil {
+		t.Fatalf("RemoveClient: %v", err)
+	}
+	if _, err := s.GetClient(client.Id); err == nil {
+		t.Error("GetClient after RemoveClient succeeded")
+	}
+}
+
+func testAuthorize(t *testing.T, s osin.Storage) {
+	client := saveClient(t, s)
+	data := newAuthorize(client)
+	if err := s.SaveAuthorize(data); err != nil {
+		t.Fatalf("SaveAuthorize: %v", err)
+	}
+
+	got, err := s.LoadAuthorize(data.Code)
+	if err != nil {
+		t.Fatalf("LoadAuthorize: %v", err)
+	}
+	assertAuthorize(t, got, data)
+	if got.UserData != "user" {
+		t.Errorf("UserData = %v, want user", got.UserData)
+	}
+
+	if err := s.RemoveAuthorize(data.Code); err != nil {
+		t.Fatalf("RemoveAuthorize: %v", err)
+	}
+	if _, err := s.LoadAuthorize(data.Code); err == nil {
+		t.Error("LoadAuthorize after RemoveAuthorize succeeded")
+	}
+}
+
+func testAccess(t *testing.T, s osin.Storage) {
+	client := saveClient(t, s)
+	authorize := newAuthorize(client)
+	if err := s.SaveAuthorize(authorize); err != nil {
+		t.Fatalf("SaveAuthorize: %v", err)
+	}
+	data := newAccess(client)
+	data.AuthorizeData = authorize
+	data.UserData = struct{ Login string }{Login: "test"}
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatalf("SaveAccess: %v", err)
+	}
+
+	got, err := s.LoadAccess(data.AccessToken)
+	if err != nil {
+		t.Fatalf("LoadAccess: %v", err)
+	}
+	assertAccess(t, got, data)
+	if got.UserData != `{"Login":"test"}` {
+		t.Errorf("UserData = %v, want %v", got.UserData, `{"Login":"test"}`)
+	}
+	if got.AuthorizeData == nil {
+		t.Error("AuthorizeData not loaded")
+	} else {
+		assertAuthorize(t, got.AuthorizeData, authorize)
+	}
+
+	if err := s.RemoveAccess(data.AccessToken); err != nil {
+		t.Fatalf("RemoveAccess: %v", err)
+	}
+	if _, err := s.LoadAccess(data.AccessToken); err == nil {
+		t.Error("LoadAccess after RemoveAccess succeeded")
+	}
+	if _, err := s.LoadRefresh(data.RefreshToken); err == nil {
+		t.Error("LoadRefresh after RemoveAccess succeeded")
+	}
+}
+
+func testRefresh(t *testing.T, s osin.Storage) {
+	client := saveClient(t, s)
+	data := newAccess(client)
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatalf("SaveAccess: %v", err)
+	}
+
+	got, err := s.LoadRefresh(data.RefreshToken)
+	if err != nil {
+		t.Fatalf("LoadRefresh: %v", err)
+	}
+	assertAccess(t, got, data)
+	if got.AuthorizeData != nil {
+		t.Errorf("AuthorizeData = %+v, want nil", got.AuthorizeData)
+	}
+	if _, err := s.LoadRefresh(data.AccessToken); err == nil {
+		t.Error("LoadRefresh by access token succeeded")
+	}
+
+	if err := s.RemoveRefresh(data.RefreshToken); err != nil {
+		t.Fatalf("RemoveRefresh: %v", err)
+	}
+	if _, err := s.LoadRefresh(data.RefreshToken); err == nil {
+		t.Error("LoadRefresh after RemoveRefresh succeeded")
+	}
+	if _, err := s.LoadAccess(data.AccessToken); err == nil {
+		t.Error("LoadAccess after RemoveRefresh succeeded")
+	}
+}
+
+// testExpiry checks that expired data either fails to load
+// or loads with CreatedAt and ExpiresIn intact so osin rejects it.
+func testExpiry(t *testing.T, s osin.Storage) {
+	client := saveClient(t, s)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	authorize := newAuthorize(client)
+	authorize.CreatedAt = past
+	if err := s.SaveAuthorize(authorize); err != nil {
+		t.Fatalf("SaveAuthorize: %v", err)
+	}
+	if got, err := s.LoadAuthorize(authorize.Code); err == nil && !got.IsExpired() {
+		t.Errorf("expired authorize data loaded as valid, expires at %v", got.ExpireAt())
+	}
+
+	access := newAccess(client)
+	access.CreatedAt = past
+	if err := s.SaveAccess(access); err != nil {
+		t.Fatalf("SaveAccess: %v", err)
+	}
+	if got, err := s.LoadAccess(access.AccessToken); err == nil && !got.IsExpired() {
+		t.Errorf("expired access data loaded as valid, expires at %v", got.ExpireAt())
+	}
+}
+
+func testConcurrency(t *testing.T, s osin.Storage) {
+	client := saveClient(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := newAccess(client)
+			if err := s.SaveAccess(data); err != nil {
+				t.Errorf("SaveAccess: %v", err)
+				return
+			}
+			for j := 0; j < 4; j++ {
+				if _, err := s.LoadAccess(data.AccessToken); err != nil {
+					t.Errorf("LoadAccess: %v", err)
+				}
+				if _, err := s.LoadRefresh(data.RefreshToken); err != nil {
+					t.Errorf("LoadRefresh: %v", err)
+				}
+				if _, err := s.GetClient(client.GetId()); err != nil {
+					t.Errorf("GetClient: %v", err)
+				}
+			}
+			if err := s.RemoveAccess(data.AccessToken); err != nil {
+				t.Errorf("RemoveAccess: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// testOpenID checks that the OpenID Connect parameters of authorize data
+// are saved and loaded back with the authorize and the access data
+func testOpenID(t *testing.T, s osin.Storage) {
+	authTime := time.Now().Truncate(time.Second)
+	oid := storage.OpenIDRequest{
+		Subject:  "subject",
+		Nonce:    "nonce",
+		AuthTime: &authTime,
+		ACR:      "urn:mace:incommon:iap:silver",
+		MaxAge:   300,
+		Claims:   `{"userinfo":{"email":null}}`,
+	}
+	client := saveClient(t, s)
+	authorize := newAuthorize(client)
+	authorize.UserData = &storage.OpenIDUserData{OpenIDRequest: oid, UserData: "user"}
+	if err := s.SaveAuthorize(authorize); err != nil {
+		t.Fatalf("SaveAuthorize: %v", err)
+	}
+	data := newAccess(client)
+	data.AuthorizeData = authorize
+	data.UserData = authorize.UserData
+	if err := s.SaveAccess(data); err != nil {
+		t.Fatalf("SaveAccess: %v", err)
+	}
+
+	gotAuthorize, err := s.LoadAuthorize(authorize.Code)
+	if err != nil {
+		t.Fatalf("LoadAuthorize: %v", err)
+	}
+	assertOpenID(t, "LoadAuthorize", gotAuthorize.UserData, oid)
+	gotAccess, err := s.LoadAccess(data.AccessToken)
+	if err != nil {
+		t.Fatalf("LoadAccess: %v", err)
+	}
+	assertOpenID(t, "LoadAccess", gotAccess.UserData, oid)
+}
+
+var counter int64
+
+// unique returns prefix followed by a suffix unique to this process run
+func unique(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), atomic.AddInt64(&counter, 1))
+}
+
+func saveClient(t *testing.T, s osin.Storage) osin.Client {
+	client := &osin.DefaultClient{Id: unique("client"), Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := s.(ClientSaver).SaveClient(client); err != nil {
+		t.Fatalf("SaveClient: %v", err)
+	}
+	return client
+}
+
+func newAuthorize(client osin.Client) *osin.AuthorizeData {
+	return &osin.AuthorizeData{
+		Client:              client,
+		Code:                unique("code"),
+		ExpiresIn:           600,
+		Scope:               "read write",
+		RedirectUri:         client.GetRedirectUri(),
+		State:               "state",
+		CreatedAt:           time.Now().Truncate(time.Second),
+		UserData:            "user",
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: "S256",
+	}
+}
+
+func newAccess(client osin.Client) *osin.AccessData {
+	return &osin.AccessData{
+		Client:       client,
+		AccessToken:  unique("access"),
+		RefreshToken: unique("refresh"),
+		ExpiresIn:    3600,
+		Scope:        "read",
+		RedirectUri:  client.GetRedirectUri(),
+		CreatedAt:    time.Now().Truncate(time.Second),
+	}
+}
+
+func assertAuthorize(t *testing.T, got, want *osin.AuthorizeData) {
+	t.Helper()
+	if got.Client == nil || got.Client.GetId() != want.Client.GetId() {
+		t.Errorf("Client = %v, want %s", got.Client, want.Client.GetId())
+	}
+	if got.Code != want.Code || got.ExpiresIn != want.ExpiresIn || got.Scope != want.Scope ||
+		got.RedirectUri != want.RedirectUri || got.State != want.State {
+		t.Errorf("AuthorizeData = %+v, want %+v", got, want)
+	}
+	if got.CodeChallenge != want.CodeChallenge || got.CodeChallengeMethod != want.CodeChallengeMethod {
+		t.Errorf("PKCE = %q %q, want %q %q", got.CodeChallenge, got.CodeChallengeMethod, want.CodeChallenge, want.CodeChallengeMethod)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, want.CreatedAt)
+	}
+}
+
+func assertAccess(t *testing.T, got, want *osin.AccessData) {
+	t.Helper()
+	if got.Client == nil || got.Client.GetId() != want.Client.GetId() {
+		t.Errorf("Client = %v, want %s", got.Client, want.Client.GetId())
+	}
+	if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || got.ExpiresIn != want.ExpiresIn ||
+		got.Scope != want.Scope || got.RedirectUri != want.RedirectUri {
+		t.Errorf("AccessData = %+v, want %+v", got, want)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, want.CreatedAt)
+	}
+}
+
+func assertOpenID(t *testing.T, name string, userData interface{}, want storage.OpenIDRequest) {
+	t.Helper()
+	got, ok := storage.OpenID(userData)
+	if !ok {
+		t.Errorf("%s: UserData = %v, want OpenID Connect parameters", name, userData)
+		return
+	}
+	if got.Subject != want.Subject || got.Nonce != want.Nonce || got.ACR != want.ACR ||
+		got.MaxAge != want.MaxAge || got.Claims != want.Claims {
+		t.Errorf("%s: OpenIDRequest = %+v, want %+v", name, got, want)
+	}
+	if got.AuthTime == nil || !got.AuthTime.Equal(*want.AuthTime) {
+		t.Errorf("%s: AuthTime = %v, want %v", name, got.AuthTime, want.AuthTime)
+	}
+}
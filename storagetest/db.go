@@ -0,0 +1,51 @@
+// Package storagetest exercises storage implementations against the osin.Storage contract.
+package storagetest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gislik/gorm"
+	_ "github.com/gislik/gorm/dialects/mysql"
+	_ "github.com/gislik/gorm/dialects/postgres"
+	_ "github.com/gislik/gorm/dialects/sqlite"
+	"github.com/gislik/osin-storage"
+)
+
+// OpenDB opens the database selected by the STORAGE_TEST_DIALECT and STORAGE_TEST_DSN
+// environment variables and migrates the tables of every storage model.
+// It defaults to an in-memory SQLite database which is closed when the test ends.
+// Tables are only dropped before migrating when STORAGE_TEST_RESET=1, set it for a dedicated
+// test database only: the OAuth tables of the database are wiped.
+//
+//	STORAGE_TEST_DIALECT=postgres STORAGE_TEST_DSN="host=localhost user=user dbname=test sslmode=disable" STORAGE_TEST_RESET=1
+//	STORAGE_TEST_DIALECT=mysql STORAGE_TEST_DSN="user:password@/test?parseTime=true" STORAGE_TEST_RESET=1
+func OpenDB(t testing.TB) *gorm.DB {
+	dialect, dsn := os.Getenv("STORAGE_TEST_DIALECT"), os.Getenv("STORAGE_TEST_DSN")
+	if dialect == "" {
+		dialect, dsn = "sqlite3", ":memory:"
+	}
+	db, err := gorm.Open(dialect, dsn)
+	if err != nil {
+		t.Fatalf("open %s: %v", dialect, err)
+	}
+	if dialect == "sqlite3" {
+		// every connection to :memory: is a new database
+		db.DB().SetMaxOpenConns(1)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tables := []interface{}{
+		&storage.Access{}, &storage.AccessScope{}, &storage.Authorize{}, &storage.Client{},
+		&storage.Scope{}, &storage.ClientScope{}, &storage.Consent{},
+		&storage.DeviceCode{}, &storage.PushedRequest{}, &storage.SigningKey{},
+		&storage.AuditEvent{}, &storage.OutboxEvent{},
+	}
+	if os.Getenv("STORAGE_TEST_RESET") == "1" {
+		db.DropTableIfExists(tables...)
+	}
+	if err := db.AutoMigrate(tables...).Error; err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
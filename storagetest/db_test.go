@@ -0,0 +1,28 @@
+package storagetest_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/gislik/osin-storage/storagetest"
+	"github.com/openshift/osin"
+)
+
+func TestOpenDBKeepsTables(t *testing.T) {
+	t.Setenv("STORAGE_TEST_DIALECT", "sqlite3")
+	t.Setenv("STORAGE_TEST_DSN", filepath.Join(t.TempDir(), "storage.db"))
+
+	s := storage.NewStorage(storagetest.OpenDB(t))
+	if err := s.SaveClient(&osin.DefaultClient{Id: "kept", Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.NewStorage(storagetest.OpenDB(t)).GetClient("kept"); err != nil {
+		t.Errorf("GetClient after reopening: %v, OpenDB dropped the tables", err)
+	}
+
+	t.Setenv("STORAGE_TEST_RESET", "1")
+	if _, err := storage.NewStorage(storagetest.OpenDB(t)).GetClient("kept"); err == nil {
+		t.Error("GetClient after reopening with STORAGE_TEST_RESET=1 succeeded")
+	}
+}
@@ -0,0 +1,162 @@
+package storagetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/openshift/osin"
+)
+
+// RunFlows drives a real osin.Server backed by s through the authorization code,
+// refresh token and client credentials flows. s must implement ClientSaver.
+func RunFlows(t *testing.T, s osin.Storage) {
+	saver, ok := s.(ClientSaver)
+	if !ok {
+		t.Fatalf("%T does not implement SaveClient", s)
+	}
+	client := &osin.DefaultClient{Id: unique("client"), Secret: "secret", RedirectUri: "http://localhost/cb"}
+	if err := saver.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient: %v", err)
+	}
+	ts := httptest.NewServer(newHandler(s))
+	defer ts.Close()
+
+	var refresh string
+	t.Run("AuthorizationCode", func(t *testing.T) {
+		code := authorize(t, ts, client)
+		res := token(t, ts, client, url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {client.RedirectUri},
+		})
+		assertIssued(t, s, res)
+		if _, err := s.LoadAuthorize(code); err == nil {
+			t.Error("authorization code not removed after exchange")
+		}
+		refresh = res["refresh_token"]
+	})
+
+	t.Run("RefreshToken", func(t *testing.T) {
+		if refresh == "" {
+			t.Skip("no refresh token issued")
+		}
+		res := token(t, ts, client, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refresh},
+		})
+		assertIssued(t, s, res)
+		if _, err := s.LoadRefresh(refresh); err == nil {
+			t.Error("refresh token still valid after refresh")
+		}
+	})
+
+	t.Run("ClientCredentials", func(t *testing.T) {
+		res := token(t, ts, client, url.Values{"grant_type": {"client_credentials"}})
+		assertIssued(t, s, res)
+	})
+}
+
+func newHandler(s osin.Storage) http.Handler {
+	config := osin.NewServerConfig()
+	config.AllowedAuthorizeTypes = osin.AllowedAuthorizeType{osin.CODE}
+	config.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE, osin.REFRESH_TOKEN, osin.CLIENT_CREDENTIALS}
+	server := osin.NewServer(config, s)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		resp := server.NewResponse()
+		defer resp.Close()
+		if ar := server.HandleAuthorizeRequest(resp, r); ar != nil {
+			ar.Authorized = true
+			server.FinishAuthorizeRequest(resp, r, ar)
+		}
+		osin.OutputJSON(resp, w, r)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		resp := server.NewResponse()
+		defer resp.Close()
+		if ar := server.HandleAccessRequest(resp, r); ar != nil {
+			ar.Authorized = true
+			server.FinishAccessRequest(resp, r, ar)
+		}
+		osin.OutputJSON(resp, w, r)
+	})
+	return mux
+}
+
+// authorize requests an authorization code for client
+func authorize(t *testing.T, ts *httptest.Server, client *osin.DefaultClient) string {
+	t.Helper()
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.Id},
+		"redirect_uri":  {client.RedirectUri},
+		"state":         {"xyz"},
+	}
+	hc := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := hc.Get(ts.URL + "/authorize?" + q.Encode())
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize redirect: %v", err)
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatalf("authorize redirect %q has no code", loc)
+	}
+	return code
+}
+
+// token posts form to the token endpoint authenticating as client
+func token(t *testing.T, ts *httptest.Server, client *osin.DefaultClient, form url.Values) map[string]string {
+	t.Helper()
+	req, err := http.NewRequest("POST", ts.URL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.Id, client.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	res := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("token response: %v", err)
+	}
+	if e, ok := res["error"]; ok {
+		t.Fatalf("token error: %v %v", e, res["error_description"])
+	}
+	out := make(map[string]string)
+	for k, v := range res {
+		if s, ok := v.(string); ok {
+			out[k] = s
+		}
+	}
+	return out
+}
+
+func assertIssued(t *testing.T, s osin.Storage, res map[string]string) {
+	t.Helper()
+	if res["access_token"] == "" {
+		t.Fatalf("no access token in %v", res)
+	}
+	if _, err := s.LoadAccess(res["access_token"]); err != nil {
+		t.Errorf("LoadAccess of issued token: %v", err)
+	}
+	if rt := res["refresh_token"]; rt != "" {
+		if _, err := s.LoadRefresh(rt); err != nil {
+			t.Errorf("LoadRefresh of issued token: %v", err)
+		}
+	}
+}
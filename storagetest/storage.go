@@ -0,0 +1,27 @@
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/gislik/osin-storage"
+	"github.com/openshift/osin"
+)
+
+// Run runs RunConformance against s and checks the Storage specific
+// ErrNotFound result of removing missing entities.
+func Run(t *testing.T, s *storage.Storage) {
+	RunConformance(t, func() osin.Storage { return s })
+	t.Run("RemoveMissing", func(t *testing.T) {
+		missing := unique("missing")
+		for name, remove := range map[string]func(string) error{
+			"RemoveClient":    s.RemoveClient,
+			"RemoveAuthorize": s.RemoveAuthorize,
+			"RemoveAccess":    s.RemoveAccess,
+			"RemoveRefresh":   s.RemoveRefresh,
+		} {
+			if err := remove(missing); err != storage.ErrNotFound {
+				t.Errorf("%s of missing entity = %v, want ErrNotFound", name, err)
+			}
+		}
+	})
+}
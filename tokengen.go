@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"strings"
+
+	"github.com/openshift/osin"
+)
+
+// Prefixes of the tokens generated by TokenGen
+const (
+	AuthorizeTokenPrefix = "oac_"
+	AccessTokenPrefix    = "oat_"
+	RefreshTokenPrefix   = "ort_"
+	DeviceCodePrefix     = "odc_"
+	PushedRequestPrefix  = "opr_"
+)
+
+const (
+	base62         = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	tokenIDLen     = 12
+	tokenSecretLen = 32
+	tokenCRCLen    = 6
+	tokenLen       = 4 + tokenIDLen + tokenSecretLen + tokenCRCLen
+)
+
+// ErrMalformedToken is returned when a token does not have the structure generated by TokenGen
+var ErrMalformedToken = errors.New("storage: malformed token")
+
+// TokenGen implements osin.AuthorizeTokenGen and osin.AccessTokenGen.
+// Tokens are made of a prefix telling their kind, a random ID, a random secret and
+// a CRC32 checksum, all base62 encoded, e.g.
+//
+//	oat_1a2B3c4D5e6F<32 chars secret><6 chars checksum>
+//
+// The checksum lets malformed tokens be rejected without a database lookup
+// and the prefix lets secret scanners detect leaked tokens.
+type TokenGen struct{}
+
+// GenerateAuthorizeToken generates an authorization code
+func (TokenGen) GenerateAuthorizeToken(data *osin.AuthorizeData) (string, error) {
+	return NewToken(AuthorizeTokenPrefix)
+}
+
+// GenerateAccessToken generates an access token and optionally a refresh token
+func (TokenGen) GenerateAccessToken(data *osin.AccessData, generaterefresh bool) (accesstoken string, refreshtoken string, err error) {
+	if accesstoken, err = NewToken(AccessTokenPrefix); err != nil {
+		return "", "", err
+	}
+	if generaterefresh {
+		if refreshtoken, err = NewToken(RefreshTokenPrefix); err != nil {
+			return "", "", err
+		}
+	}
+	return accesstoken, refreshtoken, nil
+}
+
+// NewToken generates a token with prefix
+func NewToken(prefix string) (string, error) {
+	b := make([]byte, tokenIDLen+tokenSecretLen)
+	if err := randomBase62(b); err != nil {
+		return "", err
+	}
+	token := prefix + string(b)
+	return token + checksum(token), nil
+}
+
+// ValidToken reports whether token has prefix and a valid checksum
+func ValidToken(prefix, token string) bool {
+	if len(prefix) != 4 || len(token) != tokenLen || !strings.HasPrefix(token, prefix) {
+		return false
+	}
+	for i := len(prefix); i < len(token); i++ {
+		if strings.IndexByte(base62, token[i]) < 0 {
+			return false
+		}
+	}
+	body := token[:len(token)-tokenCRCLen]
+	return checksum(body) == token[len(body):]
+}
+
+// checksum returns the base62 encoded CRC32 of s
+func checksum(s string) string {
+	n := crc32.ChecksumIEEE([]byte(s))
+	b := make([]byte, tokenCRCLen)
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = base62[n%62]
+		n /= 62
+	}
+	return string(b)
+}
+
+// randomBase62 fills b with random base62 characters
+func randomBase62(b []byte) error {
+	buf := make([]byte, len(b)*2)
+	for i := 0; i < len(b); {
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		for _, c := range buf {
+			// 248 is the largest multiple of 62 below 256, rejecting above it avoids bias
+			if c >= 248 {
+				continue
+			}
+			b[i] = base62[c%62]
+			i++
+			if i == len(b) {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gislik/osin-storage"
+)
+
+func TestValidToken(t *testing.T) {
+	token, err := storage.NewToken(storage.AccessTokenPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip the first secret character so that only the checksum is wrong
+	flipped := []byte(token)
+	if flipped[4] == 'a' {
+		flipped[4] = 'b'
+	} else {
+		flipped[4] = 'a'
+	}
+
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		token  string
+		want   bool
+	}{
+		{"valid", storage.AccessTokenPrefix, token, true},
+		{"wrong prefix", storage.RefreshTokenPrefix, token, false},
+		{"truncated", storage.AccessTokenPrefix, token[:len(token)-1], false},
+		{"bad checksum", storage.AccessTokenPrefix, string(flipped), false},
+		{"not base62", storage.AccessTokenPrefix, token[:10] + "-" + token[11:], false},
+		{"empty", storage.AccessTokenPrefix, "", false},
+	} {
+		if got := storage.ValidToken(tc.prefix, tc.token); got != tc.want {
+			t.Errorf("%s: ValidToken(%q, %q) = %v, want %v", tc.name, tc.prefix, tc.token, got, tc.want)
+		}
+	}
+}
+
+func TestTokenGen(t *testing.T) {
+	var gen storage.TokenGen
+	code, err := gen.GenerateAuthorizeToken(nil)
+	if err != nil || !storage.ValidToken(storage.AuthorizeTokenPrefix, code) {
+		t.Errorf("GenerateAuthorizeToken = %q, %v", code, err)
+	}
+	access, refresh, err := gen.GenerateAccessToken(nil, true)
+	if err != nil || !storage.ValidToken(storage.AccessTokenPrefix, access) || !storage.ValidToken(storage.RefreshTokenPrefix, refresh) {
+		t.Errorf("GenerateAccessToken = %q, %q, %v", access, refresh, err)
+	}
+	if _, refresh, _ := gen.GenerateAccessToken(nil, false); refresh != "" {
+		t.Errorf("GenerateAccessToken without refresh = %q", refresh)
+	}
+	if other, _ := storage.NewToken(storage.AccessTokenPrefix); other == access || !strings.HasPrefix(other, storage.AccessTokenPrefix) {
+		t.Errorf("NewToken = %q after %q, want a new token", other, access)
+	}
+}